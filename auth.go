@@ -0,0 +1,192 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var userAgent = fmt.Sprintf("Brewery/0.0.1 (%s; %s)", runtime.GOOS, runtime.GOARCH)
+
+// OptionWithRegistryCredentials authenticates with the bottle registry as
+// username instead of anonymously.
+func OptionWithRegistryCredentials(username, password string) func(*Brewery) {
+	return func(b *Brewery) { b.registryUser, b.registryPassword = username, password }
+}
+
+// registryToken is a bearer token for a single repository.
+type registryToken struct {
+	token   string
+	expires time.Time
+}
+
+// registryTokens caches bearer tokens by repository until they expire.
+type registryTokens struct {
+	lock   sync.Mutex
+	tokens map[string]registryToken
+}
+
+func (c *registryTokens) get(repo string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t, found := c.tokens[repo]
+	if !found || time.Now().After(t.expires) {
+		return ""
+	}
+	return t.token
+}
+
+func (c *registryTokens) set(repo string, t registryToken) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[string]registryToken{}
+	}
+	c.tokens[repo] = t
+}
+
+// registryRepository returns the host and repository of a registry URL like
+// https://ghcr.io/v2/homebrew/core/ruby/manifests/3.2.2, which is the scope
+// that tokens are issued for.
+func registryRepository(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	repo := strings.TrimPrefix(parsed.Path, "/v2/")
+	for _, sep := range []string{"/manifests/", "/blobs/"} {
+		if i := strings.LastIndex(repo, sep); i != -1 {
+			repo = repo[:i]
+		}
+	}
+	return parsed.Host + "/" + repo
+}
+
+// registryGet makes a GET request to the bottle registry, negotiating a
+// token if the registry asks for one.
+func (b *Brewery) registryGet(ctx context.Context, u string, rm func(*http.Request)) (*http.Response, error) {
+	repo := registryRepository(u)
+	prepare := func(token string) func(*http.Request) {
+		return func(r *http.Request) {
+			prepareGHCRRequest(r)
+			if rm != nil {
+				rm(r)
+			}
+			switch {
+			case token != "":
+				r.Header.Set("Authorization", "Bearer "+token)
+			case b.registryUser != "":
+				r.SetBasicAuth(b.registryUser, b.registryPassword)
+			}
+		}
+	}
+	resp, err := b._getRequest(ctx, u, prepare(b.tokens.get(repo)))
+	var statusErr *StatusCodeError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	scheme, params := parseChallenge(statusErr.Header.Get("WWW-Authenticate"))
+	if !strings.EqualFold(scheme, "Bearer") {
+		// Basic auth was already sent if there were credentials to send.
+		return nil, err
+	}
+	token, err := b.fetchRegistryToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("error authenticating with %s: %w", repo, err)
+	}
+	b.tokens.set(repo, token)
+	return b._getRequest(ctx, u, prepare(token.token))
+}
+
+// fetchRegistryToken requests a token from the realm of a Bearer challenge.
+func (b *Brewery) fetchRegistryToken(ctx context.Context, params map[string]string) (t registryToken, err error) {
+	ctx, span := networkTracer.Start(ctx, "FetchRegistryToken "+params["scope"])
+	defer span.End()
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return t, fmt.Errorf("invalid realm %q in authentication challenge", params["realm"])
+	}
+	q := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if v := params[key]; v != "" {
+			q.Set(key, v)
+		}
+	}
+	realm.RawQuery = q.Encode()
+
+	var resp struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := b.getRequest(ctx, realm.String(), func(r *http.Request) {
+		r.Header.Set("User-Agent", userAgent)
+		if b.registryUser != "" {
+			r.SetBasicAuth(b.registryUser, b.registryPassword)
+		}
+	}, &resp); err != nil {
+		return t, err
+	}
+	t.token = resp.Token
+	if t.token == "" {
+		t.token = resp.AccessToken
+	}
+	if t.token == "" {
+		return t, fmt.Errorf("no token in response from %s", realm.Host)
+	}
+	// Tokens without an expiry are valid for 60 seconds.
+	expiresIn := 60 * time.Second
+	if resp.ExpiresIn > 0 {
+		expiresIn = time.Duration(resp.ExpiresIn) * time.Second
+	}
+	issued := time.Now()
+	if !resp.IssuedAt.IsZero() && resp.IssuedAt.Before(issued) {
+		issued = resp.IssuedAt
+	}
+	// Leave some slack so a token doesn't expire mid-request.
+	t.expires = issued.Add(expiresIn - expiresIn/10)
+	return t, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// `Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:homebrew/core/ruby:pull"`.
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = map[string]string{}
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(rest, ", ") {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			// Quoted values can contain commas and escaped quotes.
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[key] = b.String()
+			if i < len(value) {
+				i++
+			}
+			rest = value[i:]
+			continue
+		}
+		value, rest, _ = strings.Cut(value, ",")
+		params[key] = strings.TrimSpace(value)
+	}
+	return scheme, params
+}
@@ -0,0 +1,123 @@
+package brewery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:homebrew/core/ruby:pull"`,
+			"Bearer",
+			map[string]string{"realm": "https://ghcr.io/token", "service": "ghcr.io", "scope": "repository:homebrew/core/ruby:pull"},
+		},
+		{
+			`Bearer realm="https://auth.example.com/token", scope="repository:a:pull,push", error=invalid_token`,
+			"Bearer",
+			map[string]string{"realm": "https://auth.example.com/token", "scope": "repository:a:pull,push", "error": "invalid_token"},
+		},
+		{`Basic realm="say \"hi\""`, "Basic", map[string]string{"realm": `say "hi"`}},
+		{"", "", map[string]string{}},
+	} {
+		scheme, params := parseChallenge(tt.header)
+		assert.Equal(t, tt.scheme, scheme, tt.header)
+		assert.Equal(t, tt.params, params, tt.header)
+	}
+}
+
+// tokenRegistry serves blobs that require a bearer token issued by /token.
+type tokenRegistry struct {
+	server *httptest.Server
+	lock   sync.Mutex
+	// scopes records the scope of every token request.
+	scopes []string
+	// basic records the credentials sent with every token request.
+	basic     []string
+	expiresIn int
+	issued    int
+}
+
+func newTokenRegistry(t *testing.T) *tokenRegistry {
+	r := &tokenRegistry{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if req.URL.Path == "/token" {
+			r.scopes = append(r.scopes, req.URL.Query().Get("scope"))
+			user, password, _ := req.BasicAuth()
+			r.basic = append(r.basic, user+":"+password)
+			r.issued++
+			fmt.Fprintf(w, `{"token": "token-%d", "expires_in": %d}`, r.issued, r.expiresIn)
+			return
+		}
+		// Only the most recently issued token is accepted.
+		if req.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", r.issued) {
+			repo := strings.TrimPrefix(registryRepository(r.server.URL+req.URL.Path), req.Host+"/")
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+				`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, r.server.URL, repo))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(w, req.URL.Path)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *tokenRegistry) get(t *testing.T, b *Brewery, path string) {
+	t.Helper()
+	resp, err := b.registryGet(context.Background(), r.server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, path, string(body))
+}
+
+func TestRegistryToken(t *testing.T) {
+	r := newTokenRegistry(t)
+	b := &Brewery{httpClient: r.server.Client()}
+
+	r.get(t, b, "/v2/homebrew/core/ruby/manifests/3.2.2")
+	r.get(t, b, "/v2/homebrew/core/ruby/blobs/sha256:abc")
+	r.get(t, b, "/v2/homebrew/core/jq/manifests/1.7")
+	// Tokens are cached per repository.
+	assert.Equal(t, []string{
+		"repository:homebrew/core/ruby:pull",
+		"repository:homebrew/core/jq:pull",
+	}, r.scopes)
+	assert.Equal(t, []string{":", ":"}, r.basic)
+
+	// An expired token is renegotiated.
+	repo := registryRepository(r.server.URL + "/v2/homebrew/core/ruby/blobs/sha256:abc")
+	b.tokens.set(repo, registryToken{token: "token-2", expires: time.Now().Add(-time.Second)})
+	r.get(t, b, "/v2/homebrew/core/ruby/blobs/sha256:abc")
+	assert.Len(t, r.scopes, 3)
+}
+
+func TestRegistryTokenCredentials(t *testing.T) {
+	r := newTokenRegistry(t)
+	r.expiresIn = 300
+	b := &Brewery{httpClient: r.server.Client()}
+	OptionWithRegistryCredentials("user", "secret")(b)
+
+	r.get(t, b, "/v2/homebrew/core/ruby/manifests/3.2.2")
+	assert.Equal(t, []string{"user:secret"}, r.basic)
+	repo := registryRepository(r.server.URL + "/v2/homebrew/core/ruby/manifests/3.2.2")
+	assert.WithinDuration(t, time.Now().Add(270*time.Second), b.tokens.tokens[repo].expires, 5*time.Second)
+}
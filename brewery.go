@@ -1,7 +1,6 @@
 package brewery
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -14,14 +13,17 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/maxmcd/brewery/internal/atomicfile"
 	"github.com/maxmcd/brewery/tracing"
-	"github.com/maxmcd/reptar"
-	"golang.org/x/sync/errgroup"
 )
 
 var (
 	brewAPIRoot = "https://formulae.brew.sh/api/"
+	// defaultFormulaTTL matches brew's default HOMEBREW_API_AUTO_UPDATE_SECS.
+	defaultFormulaTTL = 450 * time.Second
 
 	networkTracer = tracing.Init("network")
 	diskTracer    = tracing.Init("disk")
@@ -29,8 +31,30 @@ var (
 
 type Brewery struct {
 	prefix        string
+	repository    string
 	cacheLocation string
+	storeLocation string
 	httpClient    *http.Client
+	keepOldKegs   bool
+	formulaTTL    time.Duration
+	pipeline      PipelineConfig
+	streamExtract bool
+	decompressor  Decompressor
+	retry         RetryPolicy
+	offline       bool
+	lockfile      *Lockfile
+	warnings      func(error)
+	// apiDomain and artifactDomain replace formulae.brew.sh/api and ghcr.io
+	// when set.
+	apiDomain      string
+	artifactDomain string
+
+	registryUser     string
+	registryPassword string
+	tokens           registryTokens
+
+	indexLock sync.Mutex
+	index     *formulaIndex
 }
 
 type Option func(b *Brewery)
@@ -43,34 +67,87 @@ func OptionWithCache(dir string) func(*Brewery) {
 	return func(b *Brewery) { b.cacheLocation = dir }
 }
 
+// OptionWithFormulaTTL sets how long the cached formula index is used before
+// it is revalidated. A ttl of zero disables revalidation, the index is then
+// only refreshed by Update.
+func OptionWithFormulaTTL(ttl time.Duration) func(*Brewery) {
+	return func(b *Brewery) { b.formulaTTL = ttl }
+}
+
+// OptionWithAPIDomain fetches formulas from domain instead of
+// https://formulae.brew.sh/api. It defaults to $HOMEBREW_API_DOMAIN.
+func OptionWithAPIDomain(domain string) func(*Brewery) {
+	return func(b *Brewery) { b.apiDomain = strings.TrimSuffix(domain, "/") }
+}
+
+// OptionWithArtifactDomain fetches the bottles and manifests that formulas
+// list on ghcr.io from domain instead. It defaults to
+// $HOMEBREW_ARTIFACT_DOMAIN.
+func OptionWithArtifactDomain(domain string) func(*Brewery) {
+	return func(b *Brewery) { b.artifactDomain = strings.TrimSuffix(domain, "/") }
+}
+
+// OptionWithWarnings calls fn with errors that don't stop an operation, like
+// failing to revalidate a stale formula index. They are dropped otherwise.
+// fn may be called concurrently.
+func OptionWithWarnings(fn func(err error)) func(*Brewery) {
+	return func(b *Brewery) { b.warnings = fn }
+}
+
+func (b *Brewery) warn(err error) {
+	if b.warnings != nil {
+		b.warnings(err)
+	}
+}
+
+// OptionWithKeepOldKegs keeps the previous versions of formulas in the Cellar
+// when they are upgraded instead of removing them.
+func OptionWithKeepOldKegs() func(*Brewery) {
+	return func(b *Brewery) { b.keepOldKegs = true }
+}
+
 func NewBrewery(opts ...Option) (*Brewery, error) {
 	prefix, err := getBrewPrefix()
 	if err != nil {
 		return nil, fmt.Errorf("error getting brew prefix: %w: %q", err, prefix)
 	}
+	repository, err := getBrewRepository()
+	if err != nil {
+		return nil, fmt.Errorf("error getting brew repository: %w: %q", err, repository)
+	}
 	cache, err := getBrewCache()
 	if err != nil {
 		return nil, fmt.Errorf("error getting brew cache: %w: %q", err, cache)
 	}
 
-	b := &Brewery{prefix: prefix, cacheLocation: cache}
-	for _, o := range opts {
+	b := &Brewery{
+		prefix:        prefix,
+		repository:    repository,
+		cacheLocation: cache,
+		formulaTTL:    defaultFormulaTTL,
+	}
+	for _, o := range append(envOptions(), opts...) {
 		o(b)
 	}
 	if b.httpClient == nil {
 		b.httpClient = &http.Client{}
-		// timeout := 5 * time.Millisecond
-		// upto := 2
-		// hedged, err := hedgedhttp.NewClient(timeout, upto, &http.Client{})
-		// if err != nil {
-		// 	return nil, fmt.Errorf("error creating hedged http client: %w", err)
-		// }
-		// b.httpClient = hedged
-
 	}
+	b.httpClient = withRetries(b.httpClient, b.retry)
 	return b, nil
 }
 
+// envOptions returns the options set by the same environment variables that
+// configure brew.
+func envOptions() (opts []Option) {
+	if domain := os.Getenv("HOMEBREW_API_DOMAIN"); domain != "" {
+		opts = append(opts, OptionWithAPIDomain(domain))
+	}
+	if domain := os.Getenv("HOMEBREW_ARTIFACT_DOMAIN"); domain != "" {
+		opts = append(opts, OptionWithArtifactDomain(domain))
+	}
+	return opts
+}
+
 func (b *Brewery) cellar(a ...string) string {
 	return filepath.Join(append([]string{b.prefix, "/Cellar"}, a...)...)
 }
@@ -79,11 +156,35 @@ func (b *Brewery) cache(a ...string) string {
 	return filepath.Join(append([]string{b.cacheLocation}, a...)...)
 }
 
+// apiURL returns the url of name within the formula API.
+func (b *Brewery) apiURL(name string) string {
+	if b.apiDomain != "" {
+		return b.apiDomain + "/" + name
+	}
+	return brewAPIRoot + name
+}
+
+// artifactURL rewrites urls on ghcr.io to the artifact domain, if one is set.
+func (b *Brewery) artifactURL(u string) string {
+	if b.artifactDomain == "" {
+		return u
+	}
+	for _, prefix := range []string{"https://ghcr.io/", "http://ghcr.io/"} {
+		if rest, found := strings.CutPrefix(u, prefix); found {
+			return b.artifactDomain + "/" + rest
+		}
+	}
+	return u
+}
+
 func (b *Brewery) _getRequest(
 	ctx context.Context, url string, rm func(*http.Request),
 ) (
 	resp *http.Response, err error,
 ) {
+	if b.offline {
+		return nil, &OfflineError{URL: url}
+	}
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error making request for %s: %w", url, err)
@@ -96,18 +197,36 @@ func (b *Brewery) _getRequest(
 	if err != nil {
 		return nil, fmt.Errorf("error making %s request to %s: %w", http.MethodGet, url, err)
 	}
-	if resp.StatusCode != http.StatusOK {
+	conditional := req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != ""
+	ranged := req.Header.Get("Range") != ""
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case conditional && resp.StatusCode == http.StatusNotModified:
+	case ranged && resp.StatusCode == http.StatusPartialContent:
+	default:
 		var buf bytes.Buffer
 		if resp.Body != nil {
 			_, _ = io.Copy(&buf, resp.Body)
 			resp.Body.Close()
 		}
-		return nil, fmt.Errorf("unexpected status code %d when making %s request to %s: %s",
-			resp.StatusCode, http.MethodGet, url, buf.String())
+		return nil, &StatusCodeError{StatusCode: resp.StatusCode, URL: url, Header: resp.Header, Body: buf.String()}
 	}
 	return resp, nil
 }
 
+// StatusCodeError is returned for responses with an unexpected status code.
+type StatusCodeError struct {
+	StatusCode int
+	URL        string
+	Header     http.Header
+	Body       string
+}
+
+func (e *StatusCodeError) Error() string {
+	return fmt.Sprintf("unexpected status code %d when making %s request to %s: %s",
+		e.StatusCode, http.MethodGet, e.URL, e.Body)
+}
+
 func (b *Brewery) getRequest(ctx context.Context, url string, rm func(*http.Request), v interface{}) (err error) {
 	resp, err := b._getRequest(ctx, url, rm)
 	if err != nil {
@@ -124,37 +243,107 @@ func (b *Brewery) FetchFormula(ctx context.Context, name string) (f Formula, err
 	ctx, span := networkTracer.Start(ctx, "FetchFormula "+name)
 	defer span.End()
 
-	url := brewAPIRoot + "formula/" + name + ".json"
+	url := b.apiURL("formula/" + name + ".json")
 	return f, b.getRequest(ctx, url, func(r *http.Request) {}, &f)
 }
 
+// formulaMeta is stored alongside the cached formula.json so that it can be
+// revalidated with a conditional request.
+type formulaMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (b *Brewery) readFormulaMeta() (m formulaMeta) {
+	f, err := os.Open(b.cache("api", "formula.json.meta"))
+	if err != nil {
+		return m
+	}
+	defer f.Close()
+	_ = json.NewDecoder(f).Decode(&m)
+	return m
+}
+
+func (b *Brewery) writeFormulaMeta(m formulaMeta) error {
+	loc := b.cache("api", "formula.json.meta")
+	v, _ := json.Marshal(m)
+	if err := atomicfile.WriteFile(loc, bytes.NewReader(v), nil); err != nil {
+		return fmt.Errorf("error writing %q: %w", loc, err)
+	}
+	return nil
+}
+
+// Update revalidates the cached formula index, downloading it again if it
+// has changed.
+func (b *Brewery) Update(ctx context.Context) error {
+	return b.downloadAllFormulas(ctx)
+}
+
 func (b *Brewery) downloadAllFormulas(ctx context.Context) (err error) {
 	ctx, span := networkTracer.Start(ctx, "Fetch formula.json")
 	defer span.End()
-	u := "https://formulae.brew.sh/api/formula.json"
+	u := b.apiURL("formula.json")
+	loc := b.cache("api", "formula.json")
 
-	resp, err := b._getRequest(ctx, u, nil)
-	if err == nil && resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		err = fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	var meta formulaMeta
+	if _, err := os.Stat(loc); err == nil {
+		meta = b.readFormulaMeta()
 	}
+	resp, err := b._getRequest(ctx, u, func(r *http.Request) {
+		if meta.ETag != "" {
+			r.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			r.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	})
 	if err != nil {
 		return fmt.Errorf("error requesting %q: %w", u, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return b.touchFormulas(loc)
+	}
 	mkdirIfNoExist(b.cache("api"))
-	loc := b.cache("api", "formula.json")
-	f, err := os.Create(loc)
+	if err := atomicfile.WriteFile(loc, resp.Body, nil); err != nil {
+		return err
+	}
+	// Written after formula.json so that a crash in between can only leave
+	// us with metadata that is older than the file.
+	if err := b.writeFormulaMeta(formulaMeta{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}); err != nil {
+		return err
+	}
+	f, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = b.formulaIndex(ctx, f)
+	return err
+}
+
+// touchFormulas resets the clock on the ttl of an unchanged formula.json,
+// carrying its index over to the new modification time.
+func (b *Brewery) touchFormulas(loc string) error {
+	fi, err := os.Stat(loc)
 	if err != nil {
-		return fmt.Errorf("error opening file %q: %w", loc, err)
+		return err
 	}
-	if _, err = io.Copy(f, resp.Body); err != nil {
-		return fmt.Errorf("error writing to file %q: %w", loc, err)
+	idx := b.readFormulaIndex(fi)
+	now := time.Now()
+	if err := os.Chtimes(loc, now, now); err != nil {
+		return fmt.Errorf("error updating modification time of %q: %w", loc, err)
 	}
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("error closing file %q: %w", loc, err)
+	if idx == nil {
+		return nil
 	}
-	return nil
+	if fi, err = os.Stat(loc); err != nil {
+		return err
+	}
+	return b.writeFormulaIndex(idx, fi)
 }
 
 func mkdirIfNoExist(path string) {
@@ -163,127 +352,106 @@ func mkdirIfNoExist(path string) {
 	}
 }
 
-func (b *Brewery) findInstallFormulas(ctx context.Context, formula string) (formulas []Formula, err error) {
-	f, err := b.openOrDownloadAllFormulas(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("error opening or downloading all formulas: %w", err)
-	}
-	if formulas, err = findFormulas(ctx, f, formula); err != nil {
-		return nil, fmt.Errorf("error finding formula %s: %w", formula, err)
-	}
-	formulaData := formulas[0]
-	m, err := b.DownloadManifest(ctx, formulaData)
+// Install installs formula and its dependencies, stopping at the first
+// failure. Use InstallMany to find out which names were aliases or old
+// names.
+func (b *Brewery) Install(ctx context.Context, formula string) (err error) {
+	g, err := b.dependencyGraph(ctx, formula)
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving manifest for %s: %w", formulaData.Name, err)
+		return err
 	}
+	return g.firstError(b.install(ctx, g, true))
+}
+
+type InstallOptions struct {
+	// FailFast stops the whole install at the first failure instead of only
+	// skipping the formulas that depend on the one that failed.
+	FailFast bool
+}
+
+// InstallResult is the outcome of installing a single formula.
+type InstallResult struct {
+	Name string
+	// Requested is set for formulas that were named in the install, as
+	// opposed to being installed as a dependency.
+	Requested bool
+	// Resolutions lists the names other than Name that resolved to the
+	// formula, like an alias or the old name of a renamed formula, whether
+	// they were requested or named as a dependency.
+	Resolutions []Resolution
+	// Err is nil if the formula was installed.
+	Err error
+}
+
+// InstallMany installs the named formulas and the union of their
+// dependencies. Shared dependencies are resolved, downloaded and poured once.
+// A formula that fails to install only stops the formulas that depend on it,
+// unless opts.FailFast is set.
+//
+// A result is returned for every formula involved, requested names that
+// don't exist included, with dependencies before their dependents. The error
+// is only set if the install couldn't be planned at all.
+func (b *Brewery) InstallMany(ctx context.Context, names []string, opts InstallOptions) (results []InstallResult, err error) {
+	ctx, span := diskTracer.Start(ctx, "InstallMany")
+	defer span.End()
 
-	tb, err := m.TabForCurrentOS()
+	g, missing, err := b.resolveGraph(ctx, names...)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching information about the current os: %w", err)
+		return nil, err
 	}
-	dependencyFormulas := mapSlice(tb.RuntimeDependencies, func(d Dependency) string {
-		return d.FullName
-	})
-	_, _ = f.Seek(0, 0)
-	formulas, err = findFormulas(ctx, f, dependencyFormulas...)
-	if err != nil {
-		return nil, fmt.Errorf("error finding formulas %v: %w", dependencyFormulas, err)
+	if b.offline {
+		if err := b.missingArtifacts(g); err != nil {
+			return nil, err
+		}
 	}
-	return formulas, nil
-}
-
-func (b *Brewery) Install(ctx context.Context, formula string) (err error) {
-	formulas, err := b.findInstallFormulas(ctx, formula)
-	if err != nil {
-		return err
+	for _, name := range missing {
+		results = append(results, InstallResult{
+			Name:      name,
+			Requested: true,
+			Err:       &MissingFormulasError{Names: []string{name}},
+		})
 	}
-	for _, formula := range formulas {
-		if _, err := b.DownloadManifest(ctx, formula); err != nil {
-			return fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
-		}
-		if err := b.DownloadBottle(ctx, formula); err != nil {
-			return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
-		}
+	errs := b.install(ctx, g, opts.FailFast)
+	for _, name := range g.order {
+		results = append(results, InstallResult{
+			Name:        name,
+			Requested:   g.isRoot(name),
+			Resolutions: g.resolutions[name],
+			Err:         errs[name],
+		})
 	}
+	return results, nil
+}
 
-	for _, formula := range formulas {
-		if err := b.UnpackBottle(ctx, formula); err != nil {
-			return fmt.Errorf("error unpacking bottle for %s: %w", formula.Name, err)
-		}
+func (b *Brewery) downloadFormula(ctx context.Context, formula Formula) error {
+	if err := b.DownloadBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
 	}
 	return nil
 }
 
-func (b *Brewery) InstallParallel(ctx context.Context, formula string) (err error) {
-	formulas, err := b.findInstallFormulas(ctx, formula)
-	if err != nil {
-		return err
+func (b *Brewery) extractFormula(ctx context.Context, formula Formula) error {
+	if err := b.extractBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error extracting bottle for %s: %w", formula.Name, err)
 	}
+	return nil
+}
 
-	sem := make(chan struct{}, 6)
-	eg, ctx := errgroup.WithContext(ctx)
-	for _, f := range formulas {
-		formula := f
-		eg.Go(func() error {
-			sem <- struct{}{}
-			if _, err := b.DownloadManifest(ctx, formula); err != nil {
-				return fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
-			}
-			if err := b.DownloadBottle(ctx, formula); err != nil {
-				return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
-			}
-			<-sem
-			return nil
-		})
-	}
-	if err := eg.Wait(); err != nil {
-		return err
-	}
-	sem = make(chan struct{}, 6)
-	eg, ctx = errgroup.WithContext(ctx)
-	for _, f := range formulas {
-		formula := f
-		eg.Go(func() error {
-			sem <- struct{}{}
-			if err := b.UnpackBottle(ctx, formula); err != nil {
-				return fmt.Errorf("error unpacking bottle for %s: %w", formula.Name, err)
-			}
-			<-sem
-			return nil
-		})
-	}
-	if err := eg.Wait(); err != nil {
-		return err
+func (b *Brewery) unpackFormula(ctx context.Context, formula Formula) error {
+	if err := b.UnpackBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error unpacking bottle for %s: %w", formula.Name, err)
 	}
 	return nil
 }
 
-func (b *Brewery) InstallParallel2(ctx context.Context, formula string) (err error) {
-	formulas, err := b.findInstallFormulas(ctx, formula)
-	if err != nil {
-		return err
-	}
-	sem := make(chan struct{}, 6)
-	eg, ctx := errgroup.WithContext(ctx)
-	for _, f := range formulas {
-		formula := f
-		eg.Go(func() error {
-			sem <- struct{}{}
-			if _, err := b.DownloadManifest(ctx, formula); err != nil {
-				return fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
-			}
-			if err := b.DownloadBottle(ctx, formula); err != nil {
-				return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
-			}
-			if err := b.UnpackBottle(ctx, formula); err != nil {
-				return fmt.Errorf("error unpacking bottle for %s: %w", formula.Name, err)
-			}
-			<-sem
-			return nil
-		})
+// pourFormula links an unpacked formula into the prefix and writes its
+// install receipt.
+func (b *Brewery) pourFormula(ctx context.Context, formula Formula, onRequest bool) error {
+	if _, err := b.Link(ctx, formula, LinkOptions{}); err != nil {
+		return fmt.Errorf("error linking %s: %w", formula.Name, err)
 	}
-	if err := eg.Wait(); err != nil {
-		return err
+	if err := b.writeReceipt(ctx, formula, onRequest); err != nil {
+		return fmt.Errorf("error writing install receipt for %s: %w", formula.Name, err)
 	}
 	return nil
 }
@@ -298,42 +466,58 @@ func mapSlice[T any, U any](s []T, f func(T) U) []U {
 
 func (b *Brewery) openOrDownloadAllFormulas(ctx context.Context) (f *os.File, err error) {
 	loc := b.cache("api", "formula.json")
-	if _, err := os.Stat(loc); err != nil && os.IsNotExist(err) {
-		// TODO: handle other errors
+	fi, err := os.Stat(loc)
+	switch {
+	case os.IsNotExist(err) && b.offline:
+		return nil, &MissingArtifactsError{Artifacts: []string{"api/formula.json"}}
+	case os.IsNotExist(err):
 		if err := b.downloadAllFormulas(ctx); err != nil {
 			return nil, err
 		}
+	case err != nil:
+		return nil, fmt.Errorf("error checking for %q: %w", loc, err)
+	case b.formulaTTL > 0 && !b.offline && time.Since(fi.ModTime()) > b.formulaTTL:
+		if err := b.downloadAllFormulas(ctx); err != nil {
+			// A stale index is still usable.
+			b.warn(fmt.Errorf("error revalidating formula index: %w", err))
+		}
 	}
 	return os.Open(loc)
 }
 
 func (b *Brewery) DownloadManifest(ctx context.Context, formula Formula) (m Manifest, err error) {
-	u := formula.ManifestURL()
+	u := b.artifactURL(formula.ManifestURL())
 	ctx, span := networkTracer.Start(ctx, "FetchManifest "+u)
 	defer span.End()
-	filename := formula.Name + "_bottle_manifest--" + formula.annotatedVersion()
+	s := b.store()
+	ref := manifestRef(formula)
 
-	var r io.Reader
-	if _, err := os.Stat(b.cache(filename)); os.IsNotExist(err) {
-		resp, err := b._getRequest(ctx, u, prepareGHCRRequest)
-		if err != nil {
-			return Manifest{}, err
-		}
-		f, err := os.Create(b.cache(filename))
+	if digest, found := s.resolve(ref); found {
+		f, err := os.Open(s.blobPath(digest))
 		if err != nil {
-			return Manifest{}, fmt.Errorf("error creating file %q: %w", filename, err)
+			return Manifest{}, fmt.Errorf("error opening manifest %s: %w", ref, err)
 		}
-		r = io.TeeReader(resp.Body, f)
 		defer f.Close()
-	} else {
-		f, err := os.Open(b.cache(filename))
-		if err != nil {
-			return Manifest{}, fmt.Errorf("error opening file %q: %w", filename, err)
-		}
-		defer f.Close()
-		r = f
+		return m, json.NewDecoder(f).Decode(&m)
+	}
+	// Manifests are small enough that tail latency dominates.
+	resp, err := b.registryGet(withHedging(ctx), u, nil)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("error reading %q: %w", u, err)
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return Manifest{}, fmt.Errorf("error parsing manifest %q: %w", u, err)
+	}
+	digest, err := s.putBytes(body, formula.Name)
+	if err != nil {
+		return Manifest{}, err
 	}
-	return m, json.NewDecoder(r).Decode(&m)
+	return m, s.tag(ref, digest)
 }
 
 func (b *Brewery) DownloadBottle(ctx context.Context, formula Formula) (err error) {
@@ -342,48 +526,143 @@ func (b *Brewery) DownloadBottle(ctx context.Context, formula Formula) (err erro
 		return fmt.Errorf("calculating bottle url: %w", err)
 	}
 
-	filename := b.cache(formula.Name + "--" + formula.annotatedVersion())
-	ctx, span := networkTracer.Start(ctx, "DownloadBottle "+u)
-	defer span.End()
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		resp, err := b._getRequest(ctx, u, prepareGHCRRequest)
-		if err != nil {
-			return fmt.Errorf("error making request to %q: %w", u, err)
-		}
-		defer resp.Body.Close()
-		f, err := os.Create(filename)
-		if err != nil {
-			return fmt.Errorf("error creating file %q: %w", filename, err)
+	// Bottles are only added to the store after their digest has been
+	// verified, so a stored bottle is known to be good.
+	if _, found := b.cachedBottle(formula); found {
+		return nil
+	}
+	digest, err := b.expectedBottleDigest(ctx, formula)
+	if err != nil {
+		return err
+	}
+
+	s := b.store()
+	if !s.has(digest) {
+		ctx, span := networkTracer.Start(ctx, "DownloadBottle "+u)
+		defer span.End()
+		mkdirIfNoExist(s.blobDir())
+		if err := b.downloadResumable(ctx, u, s.blobPath(digest), formula.Name, digest); err != nil {
+			return err
 		}
-		_, _ = io.Copy(f, resp.Body)
 	}
-	return nil
+	return s.tag(bottleRef(formula, b.bottleOSString()), digest)
+}
+
+// expectedBottleDigest returns the sha256 the bottle for the current os must
+// have. The digest listed in the formula and the one annotated on the bottle
+// manifest must agree.
+func (b *Brewery) expectedBottleDigest(ctx context.Context, formula Formula) (string, error) {
+	m, err := b.DownloadManifest(ctx, formula)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
+	}
+	return bottleDigest(formula, m, b.bottleOSString())
+}
+
+// bottleDigest is expectedBottleDigest for a manifest that has already been
+// retrieved. Either digest may be missing, but not both.
+func bottleDigest(formula Formula, m Manifest, tag string) (string, error) {
+	expected := formula.Bottle.Stable.Files[tag].Sha256
+	manifestDigest := m.BottleDigest(formula.bottleRefName(tag))
+	switch {
+	case expected == "" && manifestDigest == "":
+		return "", fmt.Errorf("no sha256 found for %s bottle %s", formula.Name, tag)
+	case expected == "":
+		return manifestDigest, nil
+	case manifestDigest != "" && manifestDigest != expected:
+		return "", fmt.Errorf("formula and manifest disagree on the sha256 of %s bottle %s: %q != %q",
+			formula.Name, tag, expected, manifestDigest)
+	}
+	return expected, nil
+}
+
+// ChecksumMismatchError is returned when downloaded content does not match
+// the sha256 digest it was expected to have.
+type ChecksumMismatchError struct {
+	Name     string
+	Expected string
+	Actual   string
 }
 
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("sha256 mismatch for %s: expected %s, got %s", e.Name, e.Expected, e.Actual)
+}
+
+// UnpackBottle extracts the downloaded bottle for formula into the cache and
+// relocates it for this prefix.
 func (b *Brewery) UnpackBottle(ctx context.Context, formula Formula) (err error) {
+	if err := b.extractBottle(ctx, formula); err != nil {
+		return err
+	}
+	return b.relocateUnpacked(ctx, formula)
+}
+
+func (b *Brewery) unpackedBottle(formula Formula) string {
+	return b.cache(formula.Name + "--" + formula.annotatedVersion() + ".out")
+}
+
+func (b *Brewery) poured(formula Formula) bool {
+	_, err := os.Stat(b.cellar(formula.Name, formula.pkgVersion()))
+	return err == nil
+}
+
+func (b *Brewery) extractBottle(ctx context.Context, formula Formula) (err error) {
 	_, span := diskTracer.Start(ctx, "UnpackBottle "+formula.Name)
 	defer span.End()
-	bottleFile := b.cache(formula.Name + "--" + formula.annotatedVersion())
+	if b.poured(formula) {
+		return nil
+	}
+	return b.extract(formula)
+}
+
+// extract unarchives the downloaded bottle for formula into its unpacked
+// bottle directory, whether or not it has been poured already.
+func (b *Brewery) extract(formula Formula) error {
+	bottleFile, found := b.cachedBottle(formula)
+	if !found {
+		return fmt.Errorf("bottle for %s has not been downloaded", formula.Name)
+	}
 	f, err := os.Open(bottleFile)
 	if err != nil {
 		return fmt.Errorf("error opening bottle file %s: %w", bottleFile, err)
 	}
-	out := b.cache(formula.Name + "--" + formula.annotatedVersion() + ".out")
-	if err := reptar.GzipUnarchive(f, b.cache(out)); err != nil {
-		fmt.Printf("Warn: %v\n", fmt.Errorf("error unpacking archive: %v", err))
-		// return fmt.Errorf("error unpacking archive: %v", err)
-		return nil
+	defer f.Close()
+	// Unarchive next to the unpacked bottle and swap it in, a run that
+	// failed after extracting can leave files behind that the extractor
+	// won't overwrite.
+	out := b.unpackedBottle(formula)
+	staging, err := os.MkdirTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating staging dir for %q: %w", out, err)
+	}
+	defer os.RemoveAll(staging)
+	if err := b.unarchive(f, staging); err != nil {
+		return fmt.Errorf("error unpacking archive %s: %w", bottleFile, err)
+	}
+	if err := os.RemoveAll(out); err != nil {
+		return fmt.Errorf("error removing %q: %w", out, err)
+	}
+	if err := os.Rename(staging, out); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %w", staging, out, err)
 	}
 	return nil
 }
 
+// relocateUnpacked relocates the bottle extracted by extractBottle.
+func (b *Brewery) relocateUnpacked(ctx context.Context, formula Formula) error {
+	if b.poured(formula) {
+		return nil
+	}
+	return b.relocateBottle(ctx, formula, b.unpackedBottle(formula))
+}
+
 func (b *Brewery) stableBottleURL(f Formula) (string, error) {
 	files := f.Bottle.Stable.Files[b.bottleOSString()]
 	// TODO: re-enable
 	// if files.Cellar != ":any" && files.Cellar != ":any_skip_relocation" && files.Cellar != b.cellar() {
 	// 	return "", fmt.Errorf("cellar mismatch: %q != %q", files.Cellar, b.prefix)
 	// }
-	return files.URL, nil
+	return b.artifactURL(files.URL), nil
 }
 
 func (b *Brewery) bottleOSString() string {
@@ -397,47 +676,7 @@ func (b *Brewery) bottleOSString() string {
 
 func prepareGHCRRequest(req *http.Request) {
 	req.Header.Set("Accept", "application/vnd.oci.image.index.v1+json")
-	req.Header.Set("Authorization", "Bearer QQ==")
-	req.Header.Set("User-Agent", "Brewery/4.1.13 (Linux; x86_64 Ubuntu 22.04.3 LTS) curl/7.81.0")
-}
-
-func findFormulas(ctx context.Context, allFormulas io.Reader, names ...string) (formulas []Formula, err error) {
-	_, span := diskTracer.Start(ctx, "brewery.findFormulas")
-	defer span.End()
-
-	nameSet := map[string]struct{}{}
-	for _, name := range names {
-		nameSet[name] = struct{}{}
-	}
-	reader := bufio.NewReader(allFormulas)
-	decoder := json.NewDecoder(reader)
-	if _, err := decoder.Token(); err != nil {
-		return nil, fmt.Errorf("error decoding first token of formula reader: %w", err)
-	}
-	for decoder.More() {
-		var f Formula
-		if err := decoder.Decode(&f); err != nil {
-			return nil, fmt.Errorf("error decoding formula within formula list: %w", err)
-		}
-		if _, found := nameSet[f.Name]; found {
-			formulas = append(formulas, f)
-
-			if len(names) == len(formulas) {
-				return formulas, nil
-			}
-		}
-	}
-	if len(formulas) == len(names) {
-		return formulas, nil
-	}
-	for _, f := range formulas {
-		delete(nameSet, f.Name)
-	}
-	var missing []string
-	for name := range nameSet {
-		missing = append(missing, name)
-	}
-	return nil, fmt.Errorf("missing formulas: %v", missing)
+	req.Header.Set("User-Agent", userAgent)
 }
 
 type Formula struct {
@@ -542,17 +781,34 @@ type Formula struct {
 	} `json:"variations"`
 }
 
-func (f Formula) annotatedVersion() string {
+// pkgVersion is the stable version including the formula revision. This is
+// the name of the keg directory within the Cellar.
+func (f Formula) pkgVersion() string {
 	o := f.Versions.Stable
 	if f.Revision != 0 {
 		o += fmt.Sprintf("_%d", f.Revision)
 	}
+	return o
+}
+
+func (f Formula) annotatedVersion() string {
+	o := f.pkgVersion()
 	if f.Bottle.Stable.Rebuild != 0 {
 		o += fmt.Sprintf("-%d", f.Bottle.Stable.Rebuild)
 	}
 	return o
 }
 
+// bottleRefName is the image ref name used for the bottle with the given tag
+// within the bottle manifest, eg: "6.0_1.x86_64_linux.1".
+func (f Formula) bottleRefName(tag string) string {
+	o := f.pkgVersion() + "." + tag
+	if f.Bottle.Stable.Rebuild != 0 {
+		o += fmt.Sprintf(".%d", f.Bottle.Stable.Rebuild)
+	}
+	return o
+}
+
 func (f Formula) ManifestURL() string {
 	u := fmt.Sprintf(
 		"%s/%s/manifests/%s",
@@ -599,6 +855,17 @@ func (m Manifest) TabForCurrentOS() (BrewTab, error) {
 	return BrewTab{}, fmt.Errorf("no tab found for %s/%s", runtime.GOOS, runtime.GOARCH)
 }
 
+// BottleDigest returns the sh.brew.bottle.digest annotation of the manifest
+// with the given ref name, or an empty string if there is no such manifest.
+func (m Manifest) BottleDigest(refName string) string {
+	for _, m := range m.Manifests {
+		if m.Annotations.OrgOpencontainersImageRefName == refName {
+			return m.Annotations.ShBrewBottleDigest
+		}
+	}
+	return ""
+}
+
 type Dependency struct {
 	FullName         string `json:"full_name"`
 	Version          string `json:"version"`
@@ -612,14 +879,17 @@ type BrewTab struct {
 	Compiler            string       `json:"compiler"`
 	RuntimeDependencies []Dependency `json:"runtime_dependencies"`
 	Arch                string       `json:"arch"`
-	BuiltOn             struct {
-		Os            string `json:"os"`
-		OsVersion     string `json:"os_version"`
-		CPUFamily     string `json:"cpu_family"`
-		Xcode         string `json:"xcode"`
-		Clt           string `json:"clt"`
-		PreferredPerl string `json:"preferred_perl"`
-	} `json:"built_on"`
+	BuiltOn             BuiltOn      `json:"built_on"`
+}
+
+type BuiltOn struct {
+	Os            string `json:"os"`
+	OsVersion     string `json:"os_version"`
+	CPUFamily     string `json:"cpu_family"`
+	Xcode         string `json:"xcode,omitempty"`
+	Clt           string `json:"clt,omitempty"`
+	PreferredPerl string `json:"preferred_perl,omitempty"`
+	GlibcVersion  string `json:"glibc_version,omitempty"`
 }
 
 type BrewTabField struct {
@@ -649,6 +919,14 @@ func getBrewPrefix() (string, error) {
 	return "", fmt.Errorf("error calling `brew --prefix`: %w: %s", err, string(b))
 }
 
+func getBrewRepository() (string, error) {
+	b, err := exec.Command("brew", "--repository").CombinedOutput()
+	if err == nil {
+		return strings.TrimSpace(string(b)), nil
+	}
+	return "", fmt.Errorf("error calling `brew --repository`: %w: %s", err, string(b))
+}
+
 func getBrewCache() (string, error) {
 	b, err := exec.Command("brew", "--cache").CombinedOutput()
 	if err == nil {
@@ -693,36 +971,35 @@ func cloneDirWithSymlinks(src, dst string) error {
 	return nil
 }
 
+// jsonObjectSplitFunc is a bufio.SplitFunc that returns each top level
+// object within a JSON array. Braces within strings are ignored.
 func jsonObjectSplitFunc(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	opening := bytes.IndexRune(data, '{')
+	opening := bytes.IndexByte(data, '{')
 	if opening == -1 {
-		return 0, nil, nil
-	}
-	counter := 0
-
-	i := 0
-	for {
-		idx := bytes.IndexAny(data[opening+i:], "{}")
-		if idx == -1 {
-			break
-		}
-		if data[opening+i:][idx] == '{' {
-			// handle escaped "\}" or "\{"
-			if idx == 0 || data[opening+i:][idx-1] != '\\' {
-				counter++
+		// Nothing but separators so far.
+		return len(data), nil, nil
+	}
+	depth := 0
+	inString, escaped := false, false
+	for i := opening; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i + 1, data[opening : i+1], nil
 			}
 		}
-		if data[opening+i:][idx] == '}' {
-			if idx == 0 || data[opening+i:][idx-1] != '\\' {
-				counter--
-			}
-		}
-		i += idx + 1
-		if counter == 0 {
-			advance := len(data[opening:][:i]) + opening
-			// return advance, data[opening:][:i], nil
-			return advance, nil, nil
-		}
 	}
-	return 0, nil, nil
+	// Incomplete object, skip what comes before it and ask for more data.
+	return opening, nil, nil
 }
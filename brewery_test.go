@@ -1,16 +1,30 @@
 package brewery
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/maxmcd/brewery/proxy"
 	"github.com/maxmcd/brewery/tracing"
 	"github.com/maxmcd/reptar"
 	"github.com/stretchr/testify/assert"
@@ -114,9 +128,13 @@ func BenchmarkSym(b *testing.B) {
 	}
 }
 
+// rubyBottle is a bottle downloaded by brew that the unarchive benchmarks
+// extract.
+const rubyBottle = "/home/ubuntu/.cache/Homebrew/downloads/843ec2129e032ac407cc17cf9141a6ce69f8f0556061f6e1de7ecee17f4ae971--ruby--3.2.2.x86_64_linux.bottle.tar.gz"
+
 func BenchmarkGzipUnarchive(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		f, err := os.Open("/home/ubuntu/.cache/Homebrew/downloads/843ec2129e032ac407cc17cf9141a6ce69f8f0556061f6e1de7ecee17f4ae971--ruby--3.2.2.x86_64_linux.bottle.tar.gz")
+		f, err := os.Open(rubyBottle)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -131,7 +149,7 @@ func Benchmark4GzipUnarchive(b *testing.B) {
 		eg, _ := errgroup.WithContext(context.Background())
 		for i := 0; i < 8; i++ {
 			eg.Go(func() error {
-				f, err := os.Open("/home/ubuntu/.cache/Homebrew/downloads/843ec2129e032ac407cc17cf9141a6ce69f8f0556061f6e1de7ecee17f4ae971--ruby--3.2.2.x86_64_linux.bottle.tar.gz")
+				f, err := os.Open(rubyBottle)
 				if err != nil {
 					return err
 				}
@@ -149,7 +167,7 @@ func Benchmark4GzipUnarchive(b *testing.B) {
 
 func BenchmarkTarGzipUnarchive(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		f, err := os.Open("/home/ubuntu/.cache/Homebrew/downloads/843ec2129e032ac407cc17cf9141a6ce69f8f0556061f6e1de7ecee17f4ae971--ruby--3.2.2.x86_64_linux.bottle.tar.gz")
+		f, err := os.Open(rubyBottle)
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -190,36 +208,37 @@ func newRecorder(t T) *recorder.Recorder {
 	return recorder
 }
 
-func brewery(t T) *Brewery {
+func brewery(t T, opts ...Option) *Brewery {
 	recorder := newRecorder(t)
-	b, err := NewBrewery(
+	b, err := NewBrewery(append([]Option{
 		OptionWithHTTPClient(&http.Client{Transport: recorder}),
 		OptionWithCache(t.TempDir()),
-	)
+	}, opts...)...)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return b
 }
 
+// pipelineConfigs are the install pipeline configurations compared by
+// TestInstall and BenchmarkInstall.
+var pipelineConfigs = []struct {
+	name   string
+	config PipelineConfig
+}{
+	{"Sequential", PipelineConfig{Manifests: 1, Downloads: 1, Extract: 1, Relocate: 1, Link: 1}},
+	{"Default", PipelineConfig{}},
+	{"WideDownloads", PipelineConfig{Manifests: 16, Downloads: 16}},
+}
+
 func TestInstall(t *testing.T) {
-	names := []string{"Install", "InstallParallel", "InstallParallel2"}
-	for i, fn := range []func(context.Context, *Brewery) error{
-		// func(ctx context.Context, b *Brewery) error {
-		// 	return b.Install(ctx, "ruby")
-		// },
-		// func(ctx context.Context, b *Brewery) error {
-		// 	return b.InstallParallel(ctx, "ruby")
-		// },
-		func(ctx context.Context, b *Brewery) error {
-			return b.InstallParallel2(ctx, "ruby")
-		},
-	} {
-		t.Run(names[i], func(t *testing.T) {
-			ctx, span := networkTracer.Start(context.Background(), names[i])
+	for _, c := range pipelineConfigs {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			ctx, span := networkTracer.Start(context.Background(), c.name)
 			defer span.End()
-			br := brewery(t)
-			if err := fn(ctx, br); err != nil {
+			br := brewery(t, OptionWithPipeline(c.config))
+			if err := br.Install(ctx, "ruby"); err != nil {
 				t.Fatal(err)
 			}
 		})
@@ -250,23 +269,16 @@ func BenchmarkFormulaIndex(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
-	f, err := os.Open(br.cache("api", "formula.json"))
-	if err != nil {
+	if _, err := br.findFormulas(context.Background(), "ruby"); err != nil {
 		b.Fatal(err)
 	}
+	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = f.Seek(0, 0)
-		scanner := bufio.NewScanner(f)
-		scanner.Split(jsonObjectSplitFunc)
-
-		for scanner.Scan() {
-			foo := scanner.Text()
-			_ = foo
-		}
+		_, _ = br.findFormulas(context.Background(), "ruby")
 	}
 }
 
-func BenchmarkFormulaNoIndex(b *testing.B) {
+func BenchmarkBuildFormulaIndex(b *testing.B) {
 	br, err := NewBrewery()
 	if err != nil {
 		b.Fatal(err)
@@ -277,7 +289,9 @@ func BenchmarkFormulaNoIndex(b *testing.B) {
 	}
 	for i := 0; i < b.N; i++ {
 		_, _ = f.Seek(0, 0)
-		_, _ = findFormulas(context.Background(), f, "ruby")
+		if _, err := buildFormulaIndex(context.Background(), f); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
 
@@ -306,28 +320,16 @@ func Test_jsonObjectSplitFunc(t *testing.T) {
 }
 
 func BenchmarkInstall(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		br := brewery(b)
-		if err := br.Install(context.Background(), "ruby"); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
-
-func BenchmarkInstallParallel(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		br := brewery(b)
-		if err := br.InstallParallel(context.Background(), "ruby"); err != nil {
-			b.Fatal(err)
-		}
-	}
-}
-func BenchmarkInstallParallel2(b *testing.B) {
-	for i := 0; i < b.N; i++ {
-		br := brewery(b)
-		if err := br.InstallParallel2(context.Background(), "ruby"); err != nil {
-			b.Fatal(err)
-		}
+	for _, c := range pipelineConfigs {
+		c := c
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				br := brewery(b, OptionWithPipeline(c.config))
+				if err := br.Install(context.Background(), "ruby"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
 
@@ -338,11 +340,7 @@ func BenchmarkManifestCalls(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	f, err := os.Open(br.cache("api", "formula.json"))
-	if err != nil {
-		b.Fatal(err)
-	}
-	formulas, err := findFormulas(ctx, f, "ruby")
+	formulas, err := br.findFormulas(ctx, "ruby")
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -358,8 +356,7 @@ func BenchmarkManifestCalls(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	_, _ = f.Seek(0, 0)
-	formulas, err = findFormulas(ctx, f, mapSlice(tb.RuntimeDependencies, func(d Dependency) string {
+	formulas, err = br.findFormulas(ctx, mapSlice(tb.RuntimeDependencies, func(d Dependency) string {
 		return d.FullName
 	})...)
 	if err != nil {
@@ -381,3 +378,626 @@ func BenchmarkManifestCalls(b *testing.B) {
 		}
 	}
 }
+
+func testFormula(t *testing.T, rootURL, sha string) Formula {
+	var f Formula
+	if err := json.Unmarshal([]byte(fmt.Sprintf(`{
+		"name": "foo",
+		"versions": {"stable": "1.0"},
+		"bottle": {"stable": {"rebuild": 0, "root_url": %q, "files": {
+			"x86_64_linux": {"cellar": ":any", "url": %q, "sha256": %q}
+		}}}
+	}`, rootURL, rootURL+"/foo/blobs/sha256:"+sha, sha)), &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestDownloadBottleChecksum(t *testing.T) {
+	bottle := []byte("bottle contents")
+	sum := sha256.Sum256(bottle)
+	digest := hex.EncodeToString(sum[:])
+
+	for _, tt := range []struct {
+		name    string
+		served  []byte
+		wantErr bool
+	}{
+		{"match", bottle, false},
+		{"truncated", bottle[:5], true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/manifests/") {
+					_, _ = fmt.Fprintf(w, `{"manifests": [{"annotations": {
+						"org.opencontainers.image.ref.name": "1.0.x86_64_linux",
+						"sh.brew.bottle.digest": %q
+					}}]}`, digest)
+					return
+				}
+				_, _ = w.Write(tt.served)
+			}))
+			defer server.Close()
+
+			b := &Brewery{cacheLocation: t.TempDir(), httpClient: server.Client()}
+			f := testFormula(t, server.URL, digest)
+			err := b.DownloadBottle(context.Background(), f)
+			filename := b.store().blobPath(digest)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ := os.ReadFile(filename)
+				assert.Equal(t, bottle, got)
+				return
+			}
+			var mismatch *ChecksumMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected checksum mismatch error, got %v", err)
+			}
+			if _, err := os.Stat(filename); !os.IsNotExist(err) {
+				t.Fatalf("bottle with bad checksum should not be cached: %v", err)
+			}
+		})
+	}
+}
+
+func TestRelocateKeg(t *testing.T) {
+	b := &Brewery{prefix: "/opt/brew", repository: "/opt/brew/Homebrew"}
+	keg := t.TempDir()
+	write := func(name, content string, perm os.FileMode) {
+		path := filepath.Join(keg, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("lib/pkgconfig/foo.pc", "prefix=@@HOMEBREW_PREFIX@@\nlibdir=@@HOMEBREW_CELLAR@@/foo/1.0/lib\n", 0444)
+	write("bin/foo-config", "#!@@HOMEBREW_LIBRARY@@/Homebrew/shims/sh\n", 0755)
+	write("bin/foo", "\x7fELF\x00@@HOMEBREW_PREFIX@@", 0755)
+
+	changed := []string{"lib/pkgconfig/foo.pc", "bin/foo-config", "bin/foo"}
+	if err := b.relocateKeg(keg, ":any_skip_relocation", changed); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(filepath.Join(keg, "lib/pkgconfig/foo.pc"))
+	assert.Contains(t, string(got), prefixPlaceholder)
+
+	if err := b.relocateKeg(keg, ":any", changed); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = os.ReadFile(filepath.Join(keg, "lib/pkgconfig/foo.pc"))
+	assert.Equal(t, "prefix=/opt/brew\nlibdir=/opt/brew/Cellar/foo/1.0/lib\n", string(got))
+	got, _ = os.ReadFile(filepath.Join(keg, "bin/foo-config"))
+	assert.Equal(t, "#!/opt/brew/Homebrew/Library/Homebrew/shims/sh\n", string(got))
+	got, _ = os.ReadFile(filepath.Join(keg, "bin/foo"))
+	assert.Contains(t, string(got), prefixPlaceholder)
+
+	fi, err := os.Stat(filepath.Join(keg, "lib/pkgconfig/foo.pc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0444), fi.Mode().Perm())
+}
+
+func TestReceipt(t *testing.T) {
+	b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+	var tb BrewTab
+	tab, err := os.ReadFile("./testdata/brew-tab.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(tab, &tb); err != nil {
+		t.Fatal(err)
+	}
+	f := testFormula(t, "https://ghcr.io/v2/homebrew/core", "")
+	keg := b.cellar(f.Name, f.pkgVersion())
+	if err := os.MkdirAll(keg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeReceiptFile(keg, b.newReceipt(f, tb, false)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadReceipt(keg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, r.PouredFromBottle)
+	assert.True(t, r.InstalledAsDependency)
+	assert.False(t, r.InstalledOnRequest)
+	assert.Equal(t, "1.0", r.Source.Versions.Stable)
+	assert.Equal(t, tb.RuntimeDependencies, r.RuntimeDependencies)
+	assert.Equal(t, tb.ChangedFiles, r.ChangedFiles)
+
+	// brew expects empty lists rather than nulls.
+	raw, _ := os.ReadFile(filepath.Join(keg, receiptFilename))
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []interface{}{}, fields["used_options"])
+	assert.Nil(t, fields["source"].(map[string]interface{})["versions"].(map[string]interface{})["head"])
+}
+
+// testBottle describes a formula served by a testRegistry.
+type testBottle struct {
+	name     string
+	version  string
+	revision int
+	rebuild  int
+	cellar   string
+	// deps are the runtime dependencies of the bottle, brew lists the full
+	// transitive closure.
+	deps  []string
+	files map[string]string
+	// symlinks maps names in the keg to their targets, modes overrides the
+	// 0755 mode of files.
+	symlinks map[string]string
+	modes    map[string]int64
+	aliases  []string
+	oldnames []string
+	// undeclared leaves declared_directly unset in the tab, like bottles
+	// built by older versions of brew.
+	undeclared bool
+}
+
+func (tb testBottle) formula() Formula {
+	f := Formula{Name: tb.name, FullName: tb.name, Revision: tb.revision}
+	f.Versions.Stable = tb.version
+	f.Bottle.Stable.Rebuild = tb.rebuild
+	return f
+}
+
+// testRegistry serves formulas, bottle manifests and bottles the way
+// formulae.brew.sh and ghcr.io do.
+type testRegistry struct {
+	t        *testing.T
+	server   *httptest.Server
+	lock     sync.Mutex
+	formulas []byte
+	blobs    map[string][]byte
+	requests map[string]int
+	truncate bool
+	// ranges records the Range headers of requests, noRanges makes the
+	// registry ignore them.
+	ranges   []string
+	noRanges bool
+	// ghcr lists bottles on ghcr.io, as if the registry were a mirror of it.
+	ghcr bool
+}
+
+func newTestRegistry(t *testing.T, bottles ...testBottle) *testRegistry {
+	r := &testRegistry{t: t, requests: map[string]int{}}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.lock.Lock()
+		r.requests[req.URL.Path]++
+		if rng := req.Header.Get("Range"); rng != "" {
+			r.ranges = append(r.ranges, rng)
+		}
+		var body []byte
+		var found bool
+		if req.URL.Path == "/api/formula.json" {
+			body, found = r.formulas, true
+		} else {
+			body, found = r.blobs[req.URL.Path]
+		}
+		r.lock.Unlock()
+		if !found {
+			http.NotFound(w, req)
+			return
+		}
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		if req.Header.Get("Range") != "" && !r.noRanges {
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(body))
+			return
+		}
+		if r.truncate {
+			// Promise more than is sent so the client sees an unexpected EOF.
+			w.Header().Set("Content-Length", fmt.Sprint(len(body)+1))
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(r.server.Close)
+	r.set(bottles...)
+	return r
+}
+
+func (r *testRegistry) rootURL() string {
+	if r.ghcr {
+		return "https://ghcr.io/v2/homebrew/core"
+	}
+	return r.server.URL + "/v2/homebrew/core"
+}
+
+// useAPI points brewAPIRoot at the registry for the duration of the test.
+func (r *testRegistry) useAPI(t *testing.T) {
+	old := brewAPIRoot
+	brewAPIRoot = r.server.URL + "/api/"
+	t.Cleanup(func() { brewAPIRoot = old })
+}
+
+// set replaces the formulas served by the registry.
+func (r *testRegistry) set(bottles ...testBottle) {
+	t := r.t
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.blobs == nil {
+		r.blobs = map[string][]byte{}
+	}
+	var formulas []interface{}
+	for _, tb := range bottles {
+		f := tb.formula()
+		f.Bottle.Stable.RootURL = r.rootURL()
+		bottle := testBottleArchive(t, tb)
+		sum := sha256.Sum256(bottle)
+		digest := hex.EncodeToString(sum[:])
+		cellar := tb.cellar
+		if cellar == "" {
+			cellar = ":any"
+		}
+		bottleURL := fmt.Sprintf("%s/%s/blobs/sha256:%s", r.rootURL(), tb.name, digest)
+		formulas = append(formulas, map[string]interface{}{
+			"name":         tb.name,
+			"full_name":    tb.name,
+			"tap":          "homebrew/core",
+			"versions":     map[string]interface{}{"stable": tb.version, "bottle": true},
+			"revision":     tb.revision,
+			"dependencies": tb.deps,
+			"aliases":      tb.aliases,
+			"oldnames":     tb.oldnames,
+			"bottle": map[string]interface{}{"stable": map[string]interface{}{
+				"rebuild":  tb.rebuild,
+				"root_url": r.rootURL(),
+				"files": map[string]interface{}{"x86_64_linux": map[string]interface{}{
+					"cellar": cellar, "url": bottleURL, "sha256": digest,
+				}},
+			}},
+		})
+		var deps []Dependency
+		for _, dep := range tb.deps {
+			deps = append(deps, Dependency{FullName: dep, DeclaredDirectly: !tb.undeclared})
+		}
+		tab, _ := json.Marshal(BrewTab{RuntimeDependencies: deps, Arch: "x86_64"})
+		manifest, _ := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"manifests": []interface{}{map[string]interface{}{
+				"platform": map[string]string{"os": "linux", "architecture": "amd64"},
+				"annotations": map[string]string{
+					"org.opencontainers.image.ref.name": f.bottleRefName("x86_64_linux"),
+					"sh.brew.bottle.digest":             digest,
+					"sh.brew.tab":                       string(tab),
+				},
+			}},
+		})
+		u, _ := url.Parse(f.ManifestURL())
+		r.blobs[u.Path] = manifest
+		u, _ = url.Parse(bottleURL)
+		r.blobs[u.Path] = bottle
+	}
+	r.formulas, _ = json.Marshal(formulas)
+}
+
+// brewery returns a Brewery with an empty prefix that has the registry's
+// formula index in its cache.
+func (r *testRegistry) brewery(t *testing.T) *Brewery {
+	b := &Brewery{
+		prefix:        t.TempDir(),
+		cacheLocation: t.TempDir(),
+		httpClient:    r.server.Client(),
+	}
+	r.writeIndex(t, b)
+	return b
+}
+
+func (r *testRegistry) writeIndex(t *testing.T, b *Brewery) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	mkdirIfNoExist(b.cache("api"))
+	if err := os.WriteFile(b.cache("api", "formula.json"), r.formulas, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testBottleArchive(t testing.TB, tb testBottle) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	keg := path.Join(tb.name, tb.formula().pkgVersion())
+	files := map[string]string{"bin/" + tb.name: "#!/bin/sh\necho " + tb.version + "\n"}
+	for name, content := range tb.files {
+		files[name] = content
+	}
+	dirs := map[string]struct{}{}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var links []string
+	for name := range tb.symlinks {
+		links = append(links, name)
+	}
+	sort.Strings(links)
+	for _, name := range append(names, links...) {
+		for dir := path.Dir(path.Join(keg, name)); dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = struct{}{}
+		}
+	}
+	var dirNames []string
+	for dir := range dirs {
+		dirNames = append(dirNames, dir)
+	}
+	sort.Strings(dirNames)
+	for _, dir := range dirNames {
+		if err := tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		content := files[name]
+		mode, found := tb.modes[name]
+		if !found {
+			mode = 0755
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name: path.Join(keg, name), Typeflag: tar.TypeReg, Mode: mode, Size: int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write([]byte(content))
+	}
+	for _, name := range links {
+		if err := tw.WriteHeader(&tar.Header{
+			Name: path.Join(keg, name), Typeflag: tar.TypeSymlink, Linkname: tb.symlinks[name], Mode: 0777,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDomains(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t)
+	reg.ghcr = true
+	reg.set(testBottle{name: "foo", version: "1.0"})
+	t.Setenv("HOMEBREW_API_DOMAIN", "http://example.invalid/api")
+	t.Setenv("HOMEBREW_ARTIFACT_DOMAIN", reg.server.URL+"/")
+
+	b := &Brewery{cacheLocation: t.TempDir(), httpClient: reg.server.Client()}
+	// Options take precedence over the environment.
+	for _, o := range append(envOptions(), OptionWithAPIDomain(reg.server.URL+"/api/")) {
+		o(b)
+	}
+	formulas, err := b.findFormulas(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://ghcr.io/v2/homebrew/core/foo/manifests/1.0", formulas[0].ManifestURL())
+	if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, reg.requests["/api/formula.json"])
+	assert.Equal(t, 1, reg.requests["/v2/homebrew/core/foo/manifests/1.0"])
+
+	// Only urls on ghcr.io are rewritten.
+	assert.Equal(t, "https://example.com/foo", b.artifactURL("https://example.com/foo"))
+}
+
+func TestProxyDownload(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t)
+	reg.ghcr = true
+	reg.set(testBottle{name: "foo", version: "1.0"})
+	p, err := proxy.New(t.TempDir(),
+		proxy.OptionWithHTTPClient(reg.server.Client()),
+		proxy.OptionWithAPIUpstream(reg.server.URL+"/api"),
+		proxy.OptionWithRegistryUpstream(reg.server.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// Two machines sharing the proxy only download the bottle once.
+	for i := 0; i < 2; i++ {
+		b := &Brewery{cacheLocation: t.TempDir(), httpClient: server.Client()}
+		OptionWithAPIDomain(server.URL + "/api")(b)
+		OptionWithArtifactDomain(server.URL)(b)
+		formulas, err := b.findFormulas(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 2, reg.requests["/api/formula.json"])
+	assert.Equal(t, 1, reg.requests["/v2/homebrew/core/foo/manifests/1.0"])
+	for path, n := range reg.requests {
+		if strings.Contains(path, "/blobs/") {
+			assert.Equal(t, 1, n, path)
+		}
+	}
+}
+
+func TestUpdateFormulaIndex(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, testBottle{name: "foo", version: "1.0"})
+	reg.useAPI(t)
+	b := &Brewery{cacheLocation: t.TempDir(), httpClient: reg.server.Client(), formulaTTL: time.Hour}
+	loc := b.cache("api", "formula.json")
+
+	readIndex := func() []Formula {
+		t.Helper()
+		f, err := b.openOrDownloadAllFormulas(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var formulas []Formula
+		if err := json.NewDecoder(f).Decode(&formulas); err != nil {
+			t.Fatal(err)
+		}
+		return formulas
+	}
+	if formulas := readIndex(); len(formulas) != 1 || formulas[0].Versions.Stable != "1.0" {
+		t.Fatalf("unexpected index %+v", formulas)
+	}
+	if meta := b.readFormulaMeta(); meta.ETag == "" {
+		t.Fatal("expected the etag to be stored")
+	}
+
+	// Fresh within the ttl, no request is made.
+	reg.set(testBottle{name: "foo", version: "2.0"})
+	readIndex()
+	if n := reg.requests["/api/formula.json"]; n != 1 {
+		t.Fatalf("expected 1 request, got %d", n)
+	}
+
+	// Once stale the index is revalidated and replaced.
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(loc, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if formulas := readIndex(); formulas[0].Versions.Stable != "2.0" {
+		t.Fatalf("expected the index to be refreshed, got %s", formulas[0].Versions.Stable)
+	}
+
+	// An unchanged index is not downloaded again but the clock is reset.
+	if err := os.Chtimes(loc, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Update(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(loc); time.Since(fi.ModTime()) > time.Minute {
+		t.Fatal("expected modification time to be reset after a 304")
+	}
+
+	// A truncated download leaves the previous index in place.
+	reg.set(testBottle{name: "foo", version: "3.0"})
+	reg.truncate = true
+	if err := b.Update(ctx); err == nil {
+		t.Fatal("expected an error for a truncated download")
+	}
+	if formulas := readIndex(); formulas[0].Versions.Stable != "2.0" {
+		t.Fatalf("expected the previous index to be kept, got %s", formulas[0].Versions.Stable)
+	}
+	entries, _ := os.ReadDir(b.cache("api"))
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Fatalf("temporary file %s was left behind", e.Name())
+		}
+	}
+
+	// A stale index that can't be revalidated is used with a warning.
+	var warnings []error
+	OptionWithWarnings(func(err error) { warnings = append(warnings, err) })(b)
+	if err := os.Chtimes(loc, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if formulas := readIndex(); formulas[0].Versions.Stable != "2.0" {
+		t.Fatalf("expected the stale index to be used, got %s", formulas[0].Versions.Stable)
+	}
+	assert.Len(t, warnings, 1)
+}
+
+func TestLookupFormulas(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t,
+		testBottle{name: "foo", version: "1.0", aliases: []string{"foo@1"}},
+		testBottle{name: "bar", version: "2.0", oldnames: []string{"baz"}},
+		// A name wins over another formula's alias.
+		testBottle{name: "qux", version: "3.0", aliases: []string{"foo"}},
+	)
+	b := reg.brewery(t)
+
+	formulas, missing, err := b.lookupFormulas(ctx, "baz", "foo@1", "nope", "foo", "qux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range formulas {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"bar", "foo", "qux"}, names)
+	assert.Equal(t, []string{"nope"}, missing)
+	if _, err := os.Stat(b.formulaIndexPath()); err != nil {
+		t.Fatal("expected the index to be written", err)
+	}
+
+	// A new formula.json invalidates the index.
+	reg.set(testBottle{name: "foo", version: "1.1"})
+	reg.writeIndex(t, b)
+	formulas, _, err = b.lookupFormulas(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.1", formulas[0].Versions.Stable)
+
+	// As does a corrupt one.
+	if err := os.WriteFile(b.formulaIndexPath(), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.index = nil
+	if _, err := b.findFormulas(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t,
+		testBottle{name: "bar", version: "2.0", oldnames: []string{"baz"}},
+		// The tab names the dependency by its old name.
+		testBottle{name: "foo", version: "1.0", aliases: []string{"foo@1"}, deps: []string{"baz"}},
+	)
+	b := reg.brewery(t)
+
+	resolved, err := b.Resolve(ctx, "homebrew/core/foo", "foo@1", "baz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Resolution{
+		{Requested: "homebrew/core/foo", Name: "foo"},
+		{Requested: "foo@1", Name: "foo", Alias: true},
+		{Requested: "baz", Name: "bar", Renamed: true},
+	}, resolved)
+
+	_, err = b.Resolve(ctx, "foo", "nope", "homebrew/cask/foo")
+	var missingErr *MissingFormulasError
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("expected a MissingFormulasError, got %v", err)
+	}
+	assert.Equal(t, []string{"nope", "homebrew/cask/foo"}, missingErr.Names)
+
+	results, err := b.InstallMany(ctx, []string{"homebrew/core/foo@1"}, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []InstallResult{
+		{Name: "bar", Resolutions: []Resolution{{Requested: "baz", Name: "bar", Renamed: true}}},
+		{Name: "foo", Requested: true, Resolutions: []Resolution{{Requested: "homebrew/core/foo@1", Name: "foo", Alias: true}}},
+	}, results)
+	for _, keg := range []string{"foo/1.0", "bar/2.0"} {
+		if _, err := os.Stat(b.cellar(keg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
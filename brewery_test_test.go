@@ -7,7 +7,6 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"runtime"
@@ -15,6 +14,7 @@ import (
 	"testing"
 
 	"github.com/maxmcd/brewery"
+	"github.com/maxmcd/brewery/proxy"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/wait"
 	"gopkg.in/dnaeon/go-vcr.v3/recorder"
@@ -82,64 +82,19 @@ func newRecorder(t *testing.T) *recorder.Recorder {
 func TestProxy(t *testing.T) {
 	recorder := newRecorder(t)
 
-	proxyHost := ""
-	// export HOMEBREW_ARTIFACT_DOMAIN=http://localhost:3456
-	// export HOMEBREW_API_DOMAIN=http://localhost:3456
-	proxy := &httputil.ReverseProxy{
-		ModifyResponse: func(r *http.Response) error {
-			v, _ := httputil.DumpResponse(r, false)
-			fmt.Println("--------------------")
-			fmt.Println(string(v))
-			fmt.Println("--------------------")
-
-			switch r.StatusCode {
-			case http.StatusFound, http.StatusMovedPermanently, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
-				l, err := r.Location()
-				if err != nil {
-					return fmt.Errorf("error reading location header: %w", err)
-				}
-				l.Host = proxyHost
-				l.Scheme = "http"
-				r.Header.Set("Location", l.String())
-				fmt.Printf("Setting Location header to %q\n", l.String())
-			}
-			return nil
-		},
-		Rewrite: func(pr *httputil.ProxyRequest) {
-			pr.Out = pr.In
-			if strings.HasSuffix(pr.In.URL.Path, ".jws.json") {
-				pr.Out.Host = "formulae.brew.sh"
-				pr.Out.URL.Scheme = "https"
-				pr.Out.URL.Path = "/api" + pr.Out.URL.Path
-				pr.Out.URL.Host = "formulae.brew.sh"
-			}
-			fmt.Printf("%q\n", pr.In.URL.Path)
-			if strings.HasPrefix(pr.In.URL.Path, "/v2/homebrew/core") {
-				pr.Out.Host = "ghcr.io"
-				pr.Out.URL.Scheme = "https"
-				pr.Out.URL.Host = "ghcr.io"
-			}
-			if strings.HasPrefix(pr.In.URL.Path, "/ghcr1/blobs/") {
-				pr.Out.Host = "pkg-containers.githubusercontent.com"
-				pr.Out.URL.Scheme = "https"
-				pr.Out.URL.Host = "pkg-containers.githubusercontent.com"
-			}
-			v, _ := httputil.DumpRequest(pr.Out, false)
-			fmt.Println("--------------------")
-			fmt.Println(string(v))
-			fmt.Println("--------------------")
-
-		},
-		Transport: recorder,
+	// The proxy rewrites redirects to whichever host it was reached on.
+	p, err := proxy.New(t.TempDir(), proxy.OptionWithHTTPClient(&http.Client{Transport: recorder}))
+	if err != nil {
+		t.Fatal(err)
 	}
-	server := httptest.NewServer(proxy)
+	server := httptest.NewServer(p)
+	defer server.Close()
 
 	ctx := context.Background()
 
 	u, _ := url.Parse(server.URL)
 	_, port, _ := strings.Cut(u.Host, ":")
 	u.Host = dockerLocalhost() + ":" + port
-	proxyHost = u.Host
 	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 		ContainerRequest: testcontainers.ContainerRequest{
 			NetworkMode: "host",
@@ -148,7 +103,7 @@ func TestProxy(t *testing.T) {
 			Cmd: []string{"brew", "install", "-vd", "cowsay"},
 			Env: map[string]string{
 				"HOMEBREW_ARTIFACT_DOMAIN": u.String(),
-				"HOMEBREW_API_DOMAIN":      u.String(),
+				"HOMEBREW_API_DOMAIN":      u.String() + "/api",
 				"HOMEBREW_NO_AUTO_UPDATE":  "true",
 			},
 			// WaitingFor: wait.ForLog("hi"),
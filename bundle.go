@@ -0,0 +1,324 @@
+package brewery
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maxmcd/brewery/internal/atomicfile"
+)
+
+// A bundle is a tar archive laid out like the store:
+//
+//	formula.json            the formulas in the bundle, as in formula.json
+//	blobs/sha256/<digest>   manifests and bottles
+//	refs/<ref>              the digest of each manifest and bottle
+//
+// Entries are sorted and have no timestamps, so exporting the same formulas
+// twice produces the same bundle.
+
+// ExportBundle writes a bundle with names, all of their dependencies and
+// the manifests and bottles for the current os to w, downloading anything
+// that isn't in the cache yet.
+func (b *Brewery) ExportBundle(ctx context.Context, names []string, w io.Writer) error {
+	ctx, span := diskTracer.Start(ctx, "brewery.ExportBundle")
+	defer span.End()
+
+	g, err := b.dependencyGraph(ctx, names...)
+	if err != nil {
+		return err
+	}
+	if err := b.prefetch(ctx, g); err != nil {
+		return err
+	}
+	formulas, err := b.rawFormulas(ctx, g.order...)
+	if err != nil {
+		return err
+	}
+	s := b.store()
+	refs := map[string]string{}
+	for _, f := range g.sorted() {
+		for _, ref := range []string{manifestRef(f), bottleRef(f, b.bottleOSString())} {
+			digest, found := s.resolve(ref)
+			if !found {
+				return fmt.Errorf("error exporting bundle: %s is missing from the cache", ref)
+			}
+			refs[ref] = digest
+		}
+	}
+
+	tw := tar.NewWriter(w)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  time.Unix(0, 0),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return fmt.Errorf("error writing bundle: %w", err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return fmt.Errorf("error writing %s to bundle: %w", name, err)
+		}
+		return nil
+	}
+	v, err := json.Marshal(formulas)
+	if err != nil {
+		return fmt.Errorf("error encoding formulas: %w", err)
+	}
+	if err := writeEntry("formula.json", int64(len(v)), bytes.NewReader(v)); err != nil {
+		return err
+	}
+	var digests []string
+	for _, digest := range refs {
+		digests = appendUnique(digests, digest)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		if err := writeBlobEntry(s, digest, writeEntry); err != nil {
+			return err
+		}
+	}
+	var sortedRefs []string
+	for ref := range refs {
+		sortedRefs = append(sortedRefs, ref)
+	}
+	sort.Strings(sortedRefs)
+	for _, ref := range sortedRefs {
+		v := refs[ref] + "\n"
+		if err := writeEntry("refs/"+ref, int64(len(v)), strings.NewReader(v)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error writing bundle: %w", err)
+	}
+	return nil
+}
+
+func writeBlobEntry(s blobStore, digest string, writeEntry func(string, int64, io.Reader) error) error {
+	f, err := os.Open(s.blobPath(digest))
+	if err != nil {
+		return fmt.Errorf("error opening blob %s: %w", digest, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error checking blob %s: %w", digest, err)
+	}
+	return writeEntry("blobs/sha256/"+digest, fi.Size(), f)
+}
+
+// ImportBundle adds the contents of a bundle written by ExportBundle to the
+// cache. Every blob is verified against its digest and every bottle against
+// the sha256 its formula and manifest list for it. Refs and formulas are
+// only added once all of that has been checked, so a bundle that fails to
+// import leaves nothing behind that CleanupCache won't remove.
+func (b *Brewery) ImportBundle(ctx context.Context, r io.Reader) error {
+	ctx, span := diskTracer.Start(ctx, "brewery.ImportBundle")
+	defer span.End()
+
+	s := b.store()
+	refs := map[string]string{}
+	var formulas []json.RawMessage
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading bundle: %w", err)
+		}
+		switch {
+		case hdr.Name == "formula.json":
+			if err := json.NewDecoder(tr).Decode(&formulas); err != nil {
+				return fmt.Errorf("error decoding formulas in bundle: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, "blobs/sha256/"):
+			digest := strings.TrimPrefix(hdr.Name, "blobs/sha256/")
+			if !validDigest(digest) {
+				return fmt.Errorf("invalid blob %q in bundle", hdr.Name)
+			}
+			if s.has(digest) {
+				continue
+			}
+			if err := s.put(tr, hdr.Name, digest); err != nil {
+				return err
+			}
+		case strings.HasPrefix(hdr.Name, "refs/"):
+			ref := strings.TrimPrefix(hdr.Name, "refs/")
+			if !validRef(ref) {
+				return fmt.Errorf("invalid ref %q in bundle", hdr.Name)
+			}
+			v, err := io.ReadAll(io.LimitReader(tr, 128))
+			if err != nil {
+				return fmt.Errorf("error reading %s from bundle: %w", hdr.Name, err)
+			}
+			refs[ref] = strings.TrimSpace(string(v))
+		default:
+			return fmt.Errorf("unexpected entry %q in bundle", hdr.Name)
+		}
+	}
+
+	var sortedRefs []string
+	for ref, digest := range refs {
+		if !validDigest(digest) || !s.has(digest) {
+			return fmt.Errorf("bundle is missing %s for %s", digest, ref)
+		}
+		sortedRefs = append(sortedRefs, ref)
+	}
+	sort.Strings(sortedRefs)
+	if err := b.checkBundleBottles(ctx, formulas, refs); err != nil {
+		return err
+	}
+	for _, ref := range sortedRefs {
+		if err := s.tag(ref, refs[ref]); err != nil {
+			return err
+		}
+	}
+	if len(formulas) == 0 {
+		return nil
+	}
+	return b.mergeFormulas(formulas)
+}
+
+// checkBundleBottles checks that every bottle ref in a bundle points at the
+// bottle its formula lists, and that the manifest agrees. Formulas already in
+// the cache are trusted over the ones in the bundle.
+func (b *Brewery) checkBundleBottles(ctx context.Context, bundled []json.RawMessage, refs map[string]string) error {
+	var formulas []Formula
+	var names []string
+	for _, raw := range bundled {
+		var f Formula
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return fmt.Errorf("error decoding formula in bundle: %w", err)
+		}
+		formulas = append(formulas, f)
+		names = append(names, f.Name)
+	}
+	if _, err := os.Stat(b.cache("api", "formula.json")); err == nil && len(names) > 0 {
+		cached, _, err := b.lookupFormulas(ctx, names...)
+		if err != nil {
+			return err
+		}
+		formulas = append(formulas, cached...)
+	}
+	expected := map[string]string{}
+	manifests := map[string]Formula{}
+	for _, f := range formulas {
+		for tag, file := range f.Bottle.Stable.Files {
+			expected[bottleRef(f, tag)] = file.Sha256
+		}
+		manifests[manifestRef(f)] = f
+	}
+
+	s := b.store()
+	for ref, digest := range refs {
+		switch {
+		case strings.HasPrefix(ref, "bottles/"):
+			want, found := expected[ref]
+			if !found {
+				return fmt.Errorf("bundle has bottle %s, which none of its formulas list", ref)
+			}
+			if want != digest {
+				return &ChecksumMismatchError{Name: ref, Expected: want, Actual: digest}
+			}
+		case strings.HasPrefix(ref, "manifests/"):
+			f, found := manifests[ref]
+			if !found {
+				return fmt.Errorf("bundle has manifest %s, which none of its formulas list", ref)
+			}
+			v, err := os.ReadFile(s.blobPath(digest))
+			if err != nil {
+				return fmt.Errorf("error reading manifest %s: %w", ref, err)
+			}
+			var m Manifest
+			if err := json.Unmarshal(v, &m); err != nil {
+				return fmt.Errorf("error decoding manifest %s: %w", ref, err)
+			}
+			for tag := range f.Bottle.Stable.Files {
+				annotated := m.BottleDigest(f.bottleRefName(tag))
+				if bottle, found := refs[bottleRef(f, tag)]; found && annotated != "" && annotated != bottle {
+					return &ChecksumMismatchError{Name: bottleRef(f, tag), Expected: annotated, Actual: bottle}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// mergeFormulas adds the formulas that aren't in the cached formula.json to
+// it. Formulas that are already cached are kept as they are, so an old
+// bundle can't downgrade them.
+func (b *Brewery) mergeFormulas(formulas []json.RawMessage) error {
+	loc := b.cache("api", "formula.json")
+	var merged []json.RawMessage
+	if f, err := os.Open(loc); err == nil {
+		err = json.NewDecoder(f).Decode(&merged)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("error decoding %q: %w", loc, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("error opening %q: %w", loc, err)
+	}
+	cached := map[string]bool{}
+	for _, raw := range merged {
+		cached[rawFormulaName(raw)] = true
+	}
+	added := false
+	for _, raw := range formulas {
+		if cached[rawFormulaName(raw)] {
+			continue
+		}
+		merged = append(merged, raw)
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	v, err := json.Marshal(merged)
+	if err != nil {
+		return fmt.Errorf("error encoding formulas: %w", err)
+	}
+	mkdirIfNoExist(b.cache("api"))
+	return atomicfile.WriteFile(loc, bytes.NewReader(v), nil)
+}
+
+func rawFormulaName(raw json.RawMessage) string {
+	var f struct {
+		Name string `json:"name"`
+	}
+	_ = json.Unmarshal(raw, &f)
+	return f.Name
+}
+
+func validDigest(digest string) bool {
+	_, err := hex.DecodeString(digest)
+	return err == nil && len(digest) == 64 && digest == strings.ToLower(digest)
+}
+
+// validRef reports whether ref is a bottle or manifest ref that stays
+// within the refs directory.
+func validRef(ref string) bool {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 3 || (parts[0] != "bottles" && parts[0] != "manifests") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if p == "" || p == "." || p == ".." || strings.Contains(p, `\`) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,158 @@
+package brewery
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundle(t *testing.T) {
+	ctx := context.Background()
+	lib := testBottle{name: "lib", version: "1.0"}
+	app := testBottle{name: "app", version: "2.0", deps: []string{"lib"}}
+	other := testBottle{name: "other", version: "3.0"}
+	reg := newTestRegistry(t, lib, app, other)
+	online := reg.brewery(t)
+
+	var bundle bytes.Buffer
+	if err := online.ExportBundle(ctx, []string{"app"}, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := online.ExportBundle(ctx, []string{"app"}, &again); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bundle.Bytes(), again.Bytes(), "expected bundles to be reproducible")
+
+	t.Run("import", func(t *testing.T) {
+		b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+		OptionOffline()(b)
+		if err := b.ImportBundle(ctx, bytes.NewReader(bundle.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Install(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(b.cellar("lib", "1.0")); err != nil {
+			t.Fatal(err)
+		}
+		// Only the closure of app is in the bundle.
+		_, missing, err := b.lookupFormulas(ctx, "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"other"}, missing)
+	})
+	t.Run("merge", func(t *testing.T) {
+		b := reg.brewery(t)
+		OptionOffline()(b)
+		if err := b.ImportBundle(ctx, bytes.NewReader(bundle.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		formulas, missing, err := b.lookupFormulas(ctx, "app", "lib", "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, missing)
+		assert.Len(t, formulas, 3)
+	})
+	t.Run("keeps newer formulas", func(t *testing.T) {
+		newer := newTestRegistry(t, testBottle{name: "lib", version: "1.1"})
+		b := newer.brewery(t)
+		meta := b.cache("api", "formula.json.meta")
+		if err := os.WriteFile(meta, []byte(`{"etag": "\"x\""}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		OptionOffline()(b)
+		if err := b.ImportBundle(ctx, bytes.NewReader(bundle.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		formulas, err := b.findFormulas(ctx, "lib", "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "1.1", formulas[0].Versions.Stable)
+		if _, err := os.Stat(meta); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("crafted bottle", func(t *testing.T) {
+		crafted := []byte("not the bottle for lib")
+		sum := sha256.Sum256(crafted)
+		digest := hex.EncodeToString(sum[:])
+		var out bytes.Buffer
+		tw := tar.NewWriter(&out)
+		tr := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, _ := io.ReadAll(tr)
+			if strings.HasPrefix(hdr.Name, "refs/bottles/lib/") {
+				_ = tw.WriteHeader(&tar.Header{Name: "blobs/sha256/" + digest, Mode: 0644, Size: int64(len(crafted))})
+				_, _ = tw.Write(crafted)
+				v = []byte(digest + "\n")
+				hdr.Size = int64(len(v))
+			}
+			_ = tw.WriteHeader(hdr)
+			_, _ = tw.Write(v)
+		}
+		_ = tw.Close()
+
+		b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+		err := b.ImportBundle(ctx, &out)
+		var mismatch *ChecksumMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("expected a checksum mismatch, got %v", err)
+		}
+		if _, err := os.Stat(b.cache("refs")); !os.IsNotExist(err) {
+			t.Fatalf("expected no refs: %v", err)
+		}
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		var corrupt bytes.Buffer
+		tw := tar.NewWriter(&corrupt)
+		tr := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, _ := io.ReadAll(tr)
+			if strings.HasPrefix(hdr.Name, "blobs/") {
+				v[len(v)-1] ^= 0xff
+			}
+			_ = tw.WriteHeader(hdr)
+			_, _ = tw.Write(v)
+		}
+		_ = tw.Close()
+
+		b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+		err := b.ImportBundle(ctx, &corrupt)
+		var mismatch *ChecksumMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("expected a checksum mismatch, got %v", err)
+		}
+		for _, dir := range []string{"refs", "api"} {
+			if _, err := os.Stat(b.cache(dir)); !os.IsNotExist(err) {
+				t.Fatalf("expected nothing in %s: %v", dir, err)
+			}
+		}
+	})
+}
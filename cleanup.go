@@ -0,0 +1,294 @@
+package brewery
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CleanupPolicy selects what CleanupCache removes. An entry is removed if any
+// of the limits that are set applies to it.
+type CleanupPolicy struct {
+	// MaxAge removes entries that haven't been used for longer than this.
+	MaxAge time.Duration
+	// MaxSize removes the least recently used entries until the cache takes
+	// up no more than this many bytes.
+	MaxSize int64
+	// InstalledOnly removes every bottle, manifest and unpacked bottle that
+	// isn't for a keg in the Cellar. It can't be used with a store shared
+	// through OptionWithStore, whose other prefixes can't be seen.
+	InstalledOnly bool
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+}
+
+// CleanupReport lists what CleanupCache removed, or would have with DryRun.
+type CleanupReport struct {
+	Removed []string
+	// Bytes is the disk space reclaimed.
+	Bytes int64
+}
+
+// unreferencedGracePeriod is how old blobs without refs, in progress
+// downloads and the like have to be before they are removed, so that
+// cleaning up doesn't race with an install that hasn't tagged its blobs yet.
+const unreferencedGracePeriod = time.Hour
+
+// cacheEntry is a set of paths in the cache that are removed together.
+type cacheEntry struct {
+	paths    []string
+	size     int64
+	lastUsed time.Time
+	// refs are the store refs of the entry. Entries without refs that
+	// aren't stale are left alone by InstalledOnly.
+	refs []string
+	// stale entries are always removed.
+	stale bool
+}
+
+// CleanupCache removes downloaded bottles, manifests and unpacked bottles
+// from the cache according to policy. Blobs are removed together with every
+// ref that points at them, and blobs and refs that have become orphaned are
+// always removed once they are older than an hour. Only the files brewery
+// writes are considered, the formula index and anything brew keeps in the
+// cache are never removed.
+func (b *Brewery) CleanupCache(ctx context.Context, policy CleanupPolicy) (report CleanupReport, err error) {
+	ctx, span := diskTracer.Start(ctx, "brewery.CleanupCache")
+	defer span.End()
+
+	if policy.InstalledOnly && b.storeLocation != "" {
+		return report, fmt.Errorf("can't clean up only uninstalled bottles in a shared store")
+	}
+	entries, err := b.cacheEntries()
+	if err != nil {
+		return report, err
+	}
+	keep := map[string]bool{}
+	if policy.InstalledOnly {
+		kegs, err := b.installedKegs()
+		if err != nil {
+			return report, err
+		}
+		var names []string
+		for _, k := range kegs {
+			names = appendUnique(names, k.Name)
+		}
+		indexed := map[string]Formula{}
+		if len(names) > 0 {
+			formulas, _, err := b.lookupFormulas(ctx, names...)
+			if err != nil {
+				return report, err
+			}
+			for _, f := range formulas {
+				indexed[f.Name] = f
+			}
+		}
+		for _, k := range kegs {
+			f := k.formula(indexed[k.Name])
+			keep[bottleRef(f, b.bottleOSString())] = true
+			keep[manifestRef(f)] = true
+			keep[unpackedRef(f)] = true
+		}
+	}
+
+	refsDir := filepath.Join(b.store().dir, "refs")
+	now := time.Now()
+	var remaining []*cacheEntry
+	remove := func(e *cacheEntry) error {
+		report.Removed = append(report.Removed, e.paths...)
+		report.Bytes += e.size
+		if policy.DryRun {
+			return nil
+		}
+		for _, p := range e.paths {
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("error removing %q: %w", p, err)
+			}
+			// Remove the directory of a ref if it was the last one in it.
+			if dir := filepath.Dir(p); strings.HasPrefix(dir, refsDir+string(filepath.Separator)) {
+				_ = os.Remove(dir)
+			}
+		}
+		return nil
+	}
+	for _, e := range entries {
+		if len(e.refs) == 0 && now.Sub(e.lastUsed) < unreferencedGracePeriod {
+			continue
+		}
+		kept := len(e.refs) == 0
+		for _, ref := range e.refs {
+			kept = kept || keep[ref]
+		}
+		switch {
+		case e.stale,
+			policy.MaxAge > 0 && now.Sub(e.lastUsed) > policy.MaxAge,
+			policy.InstalledOnly && !kept:
+			if err := remove(e); err != nil {
+				return report, err
+			}
+		default:
+			remaining = append(remaining, e)
+		}
+	}
+	if policy.MaxSize > 0 {
+		var total int64
+		for _, e := range remaining {
+			total += e.size
+		}
+		sort.Slice(remaining, func(i, j int) bool { return remaining[i].lastUsed.Before(remaining[j].lastUsed) })
+		for _, e := range remaining {
+			if total <= policy.MaxSize {
+				break
+			}
+			if err := remove(e); err != nil {
+				return report, err
+			}
+			total -= e.size
+		}
+	}
+	return report, nil
+}
+
+// formula returns enough of the formula the keg was poured from to name its
+// bottle and manifest. brew doesn't record the bottle rebuild in receipts,
+// so for its kegs the rebuild of indexed, the formula in the index, is
+// assumed when the versions match.
+func (k installedKeg) formula(indexed Formula) Formula {
+	f := Formula{Name: k.Name}
+	f.Versions.Stable, f.Revision = splitPkgVersion(k.Version)
+	switch {
+	case k.Receipt.BottleRebuild != nil:
+		f.Bottle.Stable.Rebuild = *k.Receipt.BottleRebuild
+	case indexed.pkgVersion() == k.Version:
+		f.Bottle.Stable.Rebuild = indexed.Bottle.Stable.Rebuild
+	}
+	return f
+}
+
+// unpackedRef identifies the unpacked bottle of formula in the same way as
+// the refs of the store.
+func unpackedRef(formula Formula) string {
+	return path.Join("unpacked", formula.Name, formula.annotatedVersion())
+}
+
+// cacheEntries lists everything in the cache that can be cleaned up.
+func (b *Brewery) cacheEntries() (entries []*cacheEntry, err error) {
+	s := b.store()
+	blobs := map[string]*cacheEntry{}
+	blobDir := s.blobDir()
+	files, err := os.ReadDir(blobDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error listing %q: %w", blobDir, err)
+	}
+	for _, f := range files {
+		e, err := newCacheEntry(filepath.Join(blobDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		// In progress downloads and writes are only removed once they
+		// are old or the cache is too big.
+		if !strings.Contains(f.Name(), ".") {
+			// Blobs are stale until a ref is found for them.
+			e.stale = true
+			blobs[f.Name()] = e
+		}
+		entries = append(entries, e)
+	}
+
+	refsDir := filepath.Join(s.dir, "refs")
+	err = filepath.WalkDir(refsDir, func(p string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) && p == refsDir {
+			return filepath.SkipDir
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(refsDir, p)
+		ref := filepath.ToSlash(rel)
+		digest, _ := os.ReadFile(p)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := blobs[strings.ToLower(strings.TrimSpace(string(digest)))]
+		if e == nil {
+			// The ref points at nothing, or is being written.
+			entries = append(entries, &cacheEntry{
+				paths: []string{p}, size: fi.Size(), lastUsed: fi.ModTime(), stale: true,
+			})
+			return nil
+		}
+		// Refs are touched when they are used, so the blob was last used
+		// when its most recently used ref was.
+		if len(e.refs) == 0 || fi.ModTime().After(e.lastUsed) {
+			e.lastUsed = fi.ModTime()
+		}
+		e.stale = false
+		e.paths = append(e.paths, p)
+		e.size += fi.Size()
+		e.refs = append(e.refs, ref)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing refs: %w", err)
+	}
+
+	files, err = os.ReadDir(b.cache())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error listing cache: %w", err)
+	}
+	// Only the unpacked bottles in the root of the cache are brewery's, brew
+	// keeps its own downloads there.
+	for _, f := range files {
+		name, version, found := strings.Cut(f.Name(), "--")
+		if !found || !f.IsDir() {
+			continue
+		}
+		unpacked := strings.HasSuffix(version, ".out")
+		// Bottles being extracted while they are streamed in.
+		staging := strings.Contains(version, ".out.") && strings.HasSuffix(version, ".tmp")
+		if !unpacked && !staging {
+			continue
+		}
+		e, err := newCacheEntry(b.cache(f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if unpacked {
+			e.refs = []string{path.Join("unpacked", name, strings.TrimSuffix(version, ".out"))}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// newCacheEntry sizes the file or directory at p.
+func newCacheEntry(p string) (*cacheEntry, error) {
+	e := &cacheEntry{paths: []string{p}}
+	err := filepath.WalkDir(p, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			e.size += fi.Size()
+		}
+		if p == e.paths[0] {
+			e.lastUsed = fi.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q: %w", p, err)
+	}
+	return e, nil
+}
@@ -0,0 +1,177 @@
+package brewery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCleanupCache(t *testing.T) {
+	ctx := context.Background()
+	foo := testBottle{name: "foo", version: "1.0"}
+	bar := testBottle{name: "bar", version: "1.0", files: map[string]string{"share/bar": "some data"}}
+	reg := newTestRegistry(t, foo, bar)
+	setup := func(t *testing.T) *Brewery {
+		t.Helper()
+		b := reg.brewery(t)
+		if err := b.Install(ctx, "foo"); err != nil {
+			t.Fatal(err)
+		}
+		formulas, err := b.findFormulas(ctx, "bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	cached := func(b *Brewery, tb testBottle) bool {
+		_, found := b.cachedBottle(tb.formula())
+		return found
+	}
+	age := func(t *testing.T, b *Brewery, tb testBottle, d time.Duration) {
+		t.Helper()
+		old := time.Now().Add(-d)
+		for _, ref := range []string{bottleRef(tb.formula(), b.bottleOSString()), manifestRef(tb.formula())} {
+			if err := os.Chtimes(b.store().refPath(ref), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("installed only", func(t *testing.T) {
+		b := setup(t)
+		// brew's own downloads share the cache.
+		var brewFiles []string
+		for _, name := range []string{"baz--1.0.x86_64_linux.bottle.tar.gz", "baz_bottle_manifest--1.0"} {
+			brewFiles = append(brewFiles, b.cache(name))
+			if err := os.WriteFile(b.cache(name), []byte("brew's"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		policy := CleanupPolicy{InstalledOnly: true, DryRun: true}
+		dryRun, err := b.CleanupCache(ctx, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, cached(b, bar))
+		assert.Contains(t, dryRun.Removed, b.store().refPath(bottleRef(bar.formula(), b.bottleOSString())))
+		assert.NotContains(t, dryRun.Removed, b.store().refPath(bottleRef(foo.formula(), b.bottleOSString())))
+
+		policy.DryRun = false
+		report, err := b.CleanupCache(ctx, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, dryRun, report)
+		assert.True(t, cached(b, foo))
+		assert.False(t, cached(b, bar))
+		for _, loc := range brewFiles {
+			if _, err := os.Stat(loc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		manifests, _ := os.ReadDir(filepath.Join(b.store().dir, "refs", "manifests"))
+		assert.Len(t, manifests, 1)
+
+		// Nothing is left to clean up.
+		report, err = b.CleanupCache(ctx, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, report.Removed)
+	})
+	t.Run("max age", func(t *testing.T) {
+		b := setup(t)
+		age(t, b, bar, 48*time.Hour)
+		if _, err := b.CleanupCache(ctx, CleanupPolicy{MaxAge: 24 * time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, cached(b, foo))
+		assert.False(t, cached(b, bar))
+	})
+	t.Run("max size", func(t *testing.T) {
+		b := setup(t)
+		all, err := b.CleanupCache(ctx, CleanupPolicy{DryRun: true, MaxSize: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		uninstalled, err := b.CleanupCache(ctx, CleanupPolicy{DryRun: true, InstalledOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Using foo's bottle makes bar's the least recently used.
+		age(t, b, foo, time.Hour)
+		age(t, b, bar, 2*time.Hour)
+		if _, found := b.cachedBottle(foo.formula()); !found {
+			t.Fatal("expected foo to be cached")
+		}
+		report, err := b.CleanupCache(ctx, CleanupPolicy{MaxSize: all.Bytes - uninstalled.Bytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, uninstalled.Bytes, report.Bytes)
+		assert.True(t, cached(b, foo))
+		assert.False(t, cached(b, bar))
+	})
+	t.Run("unreferenced", func(t *testing.T) {
+		b := setup(t)
+		s := b.store()
+		// A blob an install hasn't tagged yet.
+		digest, err := s.putBytes([]byte("untagged"), "untagged")
+		if err != nil {
+			t.Fatal(err)
+		}
+		report, err := b.CleanupCache(ctx, CleanupPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, report.Removed)
+
+		old := time.Now().Add(-2 * unreferencedGracePeriod)
+		if err := os.Chtimes(s.blobPath(digest), old, old); err != nil {
+			t.Fatal(err)
+		}
+		report, err = b.CleanupCache(ctx, CleanupPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{s.blobPath(digest)}, report.Removed)
+	})
+	t.Run("brew receipt", func(t *testing.T) {
+		rebuilt := testBottle{name: "rebuilt", version: "1.0", rebuild: 1}
+		reg := newTestRegistry(t, rebuilt)
+		b := reg.brewery(t)
+		if err := b.Install(ctx, "rebuilt"); err != nil {
+			t.Fatal(err)
+		}
+		// brew doesn't record the rebuild.
+		keg := b.cellar("rebuilt", "1.0")
+		r, err := ReadReceipt(keg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.BottleRebuild = nil
+		v, _ := json.Marshal(r)
+		if err := os.WriteFile(filepath.Join(keg, receiptFilename), v, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CleanupCache(ctx, CleanupPolicy{InstalledOnly: true}); err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, cached(b, rebuilt))
+	})
+	t.Run("shared store", func(t *testing.T) {
+		b := setup(t)
+		OptionWithStore(t.TempDir())(b)
+		if _, err := b.CleanupCache(ctx, CleanupPolicy{InstalledOnly: true}); err == nil {
+			t.Fatal("expected InstalledOnly to be refused")
+		}
+	})
+}
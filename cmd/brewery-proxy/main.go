@@ -0,0 +1,41 @@
+// Command brewery-proxy runs a caching proxy for the formula API and the
+// bottle registry. Point brew or brewery at it with:
+//
+//	export HOMEBREW_API_DOMAIN=http://localhost:3456/api
+//	export HOMEBREW_ARTIFACT_DOMAIN=http://localhost:3456
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/maxmcd/brewery/proxy"
+)
+
+func main() {
+	addr := flag.String("addr", ":3456", "address to listen on")
+	dir := flag.String("cache", "", "directory to cache manifests and bottles in (default: brewery-proxy in the user cache directory)")
+	api := flag.String("api", "https://formulae.brew.sh/api", "formula API to proxy")
+	registry := flag.String("registry", "https://ghcr.io", "bottle registry to proxy")
+	flag.Parse()
+
+	if *dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			log.Fatalf("error finding cache directory: %v", err)
+		}
+		*dir = filepath.Join(cache, "brewery-proxy")
+	}
+	p, err := proxy.New(*dir,
+		proxy.OptionWithAPIUpstream(*api),
+		proxy.OptionWithRegistryUpstream(*registry),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("caching in %s, listening on %s", *dir, *addr)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
@@ -0,0 +1,51 @@
+package brewery
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/pgzip"
+	"github.com/maxmcd/reptar"
+)
+
+// Decompressor returns a reader of the decompressed contents of a bottle.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// GzipDecompressor decompresses bottles on a single goroutine with
+// compress/gzip.
+func GzipDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ParallelGzipDecompressor decompresses bottles with pgzip, which reads ahead
+// and decompresses up to blocks blocks of blockSize bytes on a separate
+// goroutine and checksums them on another.
+func ParallelGzipDecompressor(blockSize, blocks int) Decompressor {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		return pgzip.NewReaderN(r, blockSize, blocks)
+	}
+}
+
+// defaultDecompressor keeps a block per CPU in flight.
+var defaultDecompressor = ParallelGzipDecompressor(1<<20, runtime.NumCPU())
+
+// OptionWithDecompressor sets the decompressor used to extract bottles.
+func OptionWithDecompressor(d Decompressor) func(*Brewery) {
+	return func(b *Brewery) { b.decompressor = d }
+}
+
+// unarchive decompresses the bottle in r and extracts it to dir.
+func (b *Brewery) unarchive(r io.Reader, dir string) error {
+	decompressor := b.decompressor
+	if decompressor == nil {
+		decompressor = defaultDecompressor
+	}
+	zr, err := decompressor(r)
+	if err != nil {
+		return fmt.Errorf("error decompressing bottle: %w", err)
+	}
+	defer zr.Close()
+	return reptar.Unarchive(zr, dir)
+}
@@ -0,0 +1,51 @@
+package brewery
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var decompressors = []struct {
+	name         string
+	decompressor Decompressor
+}{
+	{"Gzip", GzipDecompressor},
+	{"ParallelGzip", defaultDecompressor},
+	{"ParallelGzipSmallBlocks", ParallelGzipDecompressor(250000, 16)},
+}
+
+func TestDecompressors(t *testing.T) {
+	bottle := testBottleArchive(t, testBottle{name: "foo", version: "1.0"})
+	for _, d := range decompressors {
+		t.Run(d.name, func(t *testing.T) {
+			b := &Brewery{decompressor: d.decompressor}
+			dir := t.TempDir()
+			if err := b.unarchive(bytes.NewReader(bottle), dir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "foo", "1.0", "bin", "foo")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func BenchmarkUnarchive(b *testing.B) {
+	bottle, err := os.ReadFile(rubyBottle)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, d := range decompressors {
+		b.Run(d.name, func(b *testing.B) {
+			br := &Brewery{decompressor: d.decompressor}
+			b.SetBytes(int64(len(bottle)))
+			for i := 0; i < b.N; i++ {
+				if err := br.unarchive(bytes.NewReader(bottle), b.TempDir()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package brewery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// downloadResumable downloads u to filename by way of filename.incomplete.
+// If an earlier download was interrupted the partial file is resumed with a
+// Range request, starting over if the server doesn't honour it. The complete
+// file must match digest before it is renamed into place, otherwise the
+// partial file is discarded. The partial file is locked while it is written,
+// so a second download of filename, say by another process sharing the
+// store, waits for the first and uses its file.
+func (b *Brewery) downloadResumable(ctx context.Context, u, filename, name, digest string) (err error) {
+	partial := filename + ".incomplete"
+	f, done, err := lockPartial(filename)
+	if err != nil || done {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+		}
+	}()
+
+	// Hashing what is already there also leaves f positioned at its end.
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", partial, err)
+	}
+	resp, err := b.registryGet(ctx, u, func(r *http.Request) {
+		if offset > 0 {
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	})
+	var statusErr *StatusCodeError
+	if offset > 0 && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// The partial file is no prefix of the bottle, most likely because
+		// it is already as long as the bottle.
+		if err := restartDownload(f, h); err != nil {
+			return err
+		}
+		offset = 0
+		resp, err = b.registryGet(ctx, u, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("error making request to %q: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if offset > 0 && !resumesAt(resp, offset) {
+		// The server sent the whole bottle.
+		if err := restartDownload(f, h); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return fmt.Errorf("error downloading %q, the partial download is kept to be resumed: %w", u, err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error syncing file %q: %w", partial, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, digest) {
+		_ = os.Remove(partial)
+		return &ChecksumMismatchError{Name: name, Expected: digest, Actual: actual}
+	}
+	// Rename before unlocking, so that waiting downloads find filename.
+	if err := os.Rename(partial, filename); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %w", partial, filename, err)
+	}
+	return nil
+}
+
+// lockPartial opens and exclusively locks the partial download of filename,
+// waiting for any other download of it. done is set instead if that download
+// completed filename in the meantime.
+func lockPartial(filename string) (f *os.File, done bool, err error) {
+	partial := filename + ".incomplete"
+	for {
+		f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, false, fmt.Errorf("error opening %q: %w", partial, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			_ = f.Close()
+			return nil, false, fmt.Errorf("error locking %q: %w", partial, err)
+		}
+		if _, err := os.Stat(filename); err == nil {
+			// Opening partial may have created it again.
+			_ = os.Remove(partial)
+			_ = f.Close()
+			return nil, true, nil
+		}
+		// The download we waited for may have renamed or removed the file we
+		// locked, only the file at partial can be resumed.
+		locked, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return nil, false, fmt.Errorf("error reading %q: %w", partial, err)
+		}
+		if current, err := os.Stat(partial); err == nil && os.SameFile(locked, current) {
+			return f, false, nil
+		}
+		_ = f.Close()
+	}
+}
+
+// resumesAt reports whether resp is the content of the requested resource
+// from offset onwards.
+func resumesAt(resp *http.Response, offset int64) bool {
+	return resp.StatusCode == http.StatusPartialContent &&
+		strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset))
+}
+
+func restartDownload(f *os.File, h hash.Hash) error {
+	h.Reset()
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating %q: %w", f.Name(), err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error seeking %q: %w", f.Name(), err)
+	}
+	return nil
+}
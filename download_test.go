@@ -0,0 +1,140 @@
+package brewery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadBottleResume(t *testing.T) {
+	ctx := context.Background()
+	foo := testBottle{name: "foo", version: "1.0", files: map[string]string{"share/foo/data": "some data"}}
+	bottle := testBottleArchive(t, foo)
+	reg := newTestRegistry(t, foo)
+	b := reg.brewery(t)
+	formulas, err := b.findFormulas(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	formula := formulas[0]
+	sum := sha256.Sum256(bottle)
+	filename := b.store().blobPath(hex.EncodeToString(sum[:]))
+	partial := filename + ".incomplete"
+	mkdirIfNoExist(filepath.Dir(filename))
+	download := func(t *testing.T, prefix []byte) error {
+		t.Helper()
+		_ = os.Remove(filename)
+		reg.ranges = nil
+		if prefix != nil {
+			if err := os.WriteFile(partial, prefix, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b.DownloadBottle(ctx, formula)
+	}
+	assertDownloaded := func(t *testing.T) {
+		t.Helper()
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, bottle, got)
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", partial, err)
+		}
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		if err := download(t, bottle[:len(bottle)/2]); err != nil {
+			t.Fatal(err)
+		}
+		assertDownloaded(t)
+		assert.Equal(t, []string{fmt.Sprintf("bytes=%d-", len(bottle)/2)}, reg.ranges)
+	})
+	t.Run("ranges unsupported", func(t *testing.T) {
+		reg.noRanges = true
+		defer func() { reg.noRanges = false }()
+		if err := download(t, []byte("not a prefix")); err != nil {
+			t.Fatal(err)
+		}
+		assertDownloaded(t)
+	})
+	t.Run("interrupted", func(t *testing.T) {
+		reg.truncate = true
+		err := download(t, nil)
+		reg.truncate = false
+		if err == nil {
+			t.Fatal("expected an error for an interrupted download")
+		}
+		if _, err := os.Stat(partial); err != nil {
+			t.Fatal("expected the partial download to be kept", err)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Fatalf("expected no bottle after an interrupted download: %v", err)
+		}
+		// The whole bottle arrived before the connection dropped, so the
+		// range can't be satisfied and the download starts over.
+		if err := b.DownloadBottle(ctx, formula); err != nil {
+			t.Fatal(err)
+		}
+		assertDownloaded(t)
+	})
+	t.Run("corrupt partial", func(t *testing.T) {
+		corrupt := append([]byte{}, bottle[:len(bottle)/2]...)
+		corrupt[0] ^= 0xff
+		err := download(t, corrupt)
+		var mismatch *ChecksumMismatchError
+		if !errors.As(err, &mismatch) {
+			t.Fatalf("expected a checksum mismatch, got %v", err)
+		}
+		if _, err := os.Stat(partial); !os.IsNotExist(err) {
+			t.Fatalf("expected the corrupt partial download to be removed: %v", err)
+		}
+		if err := b.DownloadBottle(ctx, formula); err != nil {
+			t.Fatal(err)
+		}
+		assertDownloaded(t)
+	})
+	t.Run("shared store", func(t *testing.T) {
+		store := t.TempDir()
+		bottlePath := fmt.Sprintf("/v2/homebrew/core/foo/blobs/sha256:%x", sum)
+		reg.lock.Lock()
+		before := reg.requests[bottlePath]
+		reg.lock.Unlock()
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			i, b := i, reg.brewery(t)
+			OptionWithStore(store)(b)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = b.DownloadBottle(ctx, formula)
+			}()
+		}
+		wg.Wait()
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+		reg.lock.Lock()
+		assert.Equal(t, 1, reg.requests[bottlePath]-before)
+		reg.lock.Unlock()
+		shared := blobStore{dir: store}.blobPath(hex.EncodeToString(sum[:]))
+		got, err := os.ReadFile(shared)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, bottle, got)
+		if _, err := os.Stat(shared + ".incomplete"); !os.IsNotExist(err) {
+			t.Fatalf("expected no partial download to be left: %v", err)
+		}
+	})
+}
@@ -0,0 +1,501 @@
+package brewery
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// relocateELFFiles rewrites the interpreter and runpath of every ELF file
+// within keg.
+func relocateELFFiles(keg string, r *strings.Replacer) error {
+	return filepath.WalkDir(keg, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := relocateELF(path, r); err != nil {
+			return fmt.Errorf("error relocating %q: %w", path, err)
+		}
+		return nil
+	})
+}
+
+// relocateELF rewrites the interpreter and runpath of the file at path with r.
+// Files that are not ELF files are left untouched.
+func relocateELF(path string, r *strings.Replacer) error {
+	isELF, err := hasELFMagic(path)
+	if err != nil || !isELF {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	out, changed, err := rewriteELF(data, r.Replace)
+	var formatErr *elf.FormatError
+	if errors.As(err, &formatErr) {
+		// Data that merely starts with the ELF magic, leave it be.
+		return nil
+	}
+	if err != nil || !changed {
+		return err
+	}
+	perm := fi.Mode().Perm()
+	if err := os.Chmod(path, perm|0200); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, out, perm); err != nil {
+		return err
+	}
+	return os.Chmod(path, perm)
+}
+
+func hasELFMagic(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(elf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return string(magic) == elf.ELFMAG, nil
+}
+
+// elfStringRewrite is a NUL terminated string within an ELF file that is
+// being replaced.
+type elfStringRewrite struct {
+	off    uint64 // file offset of the original string
+	size   uint64 // space available at off, including the NUL terminator
+	newVal string
+}
+
+func (s elfStringRewrite) fits() bool { return uint64(len(s.newVal)) < s.size }
+
+// elfRewriter patches the PT_INTERP segment and the DT_RPATH/DT_RUNPATH
+// entries of an ELF file.
+//
+// Strings that still fit in their original slot are overwritten in place.
+// Anything that grows is written into a new PT_LOAD segment appended to the
+// end of the file. The new segment holds a copy of the program header table
+// (so that there is room for the extra entry), the new interpreter and a copy
+// of the dynamic string table with the new runpaths appended to it. The
+// PT_PHDR, PT_INTERP, DT_STRTAB and DT_STRSZ entries are then pointed at the
+// new locations.
+type elfRewriter struct {
+	f     *elf.File
+	data  []byte
+	order binary.ByteOrder
+	is64  bool
+}
+
+// rewriteELF applies fn to the interpreter and runpaths of the ELF file in
+// data and returns the patched file.
+func rewriteELF(data []byte, fn func(string) string) (out []byte, changed bool, err error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, false, fmt.Errorf("error parsing elf file: %w", err)
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return data, false, nil
+	}
+	w := &elfRewriter{
+		f:     f,
+		data:  append([]byte(nil), data...),
+		order: f.ByteOrder,
+		is64:  f.Class == elf.ELFCLASS64,
+	}
+	return w.rewrite(fn)
+}
+
+func (w *elfRewriter) rewrite(fn func(string) string) ([]byte, bool, error) {
+	var interp *elfStringRewrite
+	for _, p := range w.f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		if p.Off+p.Filesz > uint64(len(w.data)) {
+			return nil, false, fmt.Errorf("PT_INTERP segment is out of bounds")
+		}
+		old := cString(w.data[p.Off : p.Off+p.Filesz])
+		if v := fn(old); v != old {
+			interp = &elfStringRewrite{off: p.Off, size: p.Filesz, newVal: v}
+		}
+	}
+
+	dyn, err := w.dynamicEntries()
+	if err != nil {
+		return nil, false, err
+	}
+	var strtab, strsz uint64
+	for _, d := range dyn {
+		switch d.tag {
+		case elf.DT_STRTAB:
+			strtab = d.val
+		case elf.DT_STRSZ:
+			strsz = d.val
+		}
+	}
+	// DT_RPATH and DT_RUNPATH may share a string, so rewrites are keyed by
+	// their offset within the string table.
+	paths := map[uint64]*elfStringRewrite{}
+	var pathOffsets []uint64
+	if strtab != 0 {
+		strtabOff, err := w.vaddrToOffset(strtab)
+		if err != nil {
+			return nil, false, fmt.Errorf("error locating dynamic string table: %w", err)
+		}
+		if strtabOff+strsz > uint64(len(w.data)) {
+			return nil, false, fmt.Errorf("dynamic string table is out of bounds")
+		}
+		table := w.data[strtabOff : strtabOff+strsz]
+		for _, d := range dyn {
+			if d.tag != elf.DT_RPATH && d.tag != elf.DT_RUNPATH {
+				continue
+			}
+			if _, found := paths[d.val]; found || d.val >= strsz {
+				continue
+			}
+			old := cString(table[d.val:])
+			if v := fn(old); v != old {
+				paths[d.val] = &elfStringRewrite{
+					off:    strtabOff + d.val,
+					size:   uint64(len(old)) + 1,
+					newVal: v,
+				}
+				pathOffsets = append(pathOffsets, d.val)
+			}
+		}
+	}
+
+	if interp == nil && len(paths) == 0 {
+		return w.data, false, nil
+	}
+
+	grow := interp != nil && !interp.fits()
+	for _, s := range paths {
+		grow = grow || !s.fits()
+	}
+	if !grow {
+		if interp != nil {
+			w.overwriteString(*interp)
+		}
+		for _, s := range paths {
+			w.overwriteString(*s)
+		}
+		return w.data, true, nil
+	}
+	if err := w.appendSegment(interp, dyn, strtab, strsz, paths, pathOffsets); err != nil {
+		return nil, false, err
+	}
+	return w.data, true, nil
+}
+
+// appendSegment writes everything that has changed into a new PT_LOAD segment
+// at the end of the file.
+func (w *elfRewriter) appendSegment(
+	interp *elfStringRewrite,
+	dyn []elfDyn,
+	strtab, strsz uint64,
+	paths map[uint64]*elfStringRewrite,
+	pathOffsets []uint64,
+) error {
+	var firstLoad, lastLoad *elf.Prog
+	var pageSize, maxEnd uint64 = 0x1000, 0
+	for _, p := range w.f.Progs {
+		if p.Type != elf.PT_LOAD {
+			continue
+		}
+		if firstLoad == nil || p.Vaddr < firstLoad.Vaddr {
+			firstLoad = p
+		}
+		lastLoad = p
+		if p.Align > pageSize {
+			pageSize = p.Align
+		}
+		if end := p.Vaddr + p.Memsz; end > maxEnd {
+			maxEnd = end
+		}
+	}
+	if firstLoad == nil {
+		return fmt.Errorf("elf file has no loadable segments")
+	}
+
+	// The kernel derives AT_PHDR from e_phoff and the address of the first
+	// loadable segment, so the new segment must keep the same difference
+	// between virtual address and file offset as the first one.
+	delta := firstLoad.Vaddr - firstLoad.Off
+	newOff := uint64(len(w.data))
+	if maxEnd-delta > newOff {
+		newOff = maxEnd - delta
+	}
+	newOff = alignUp(newOff, pageSize)
+	newVaddr := newOff + delta
+
+	progSize := uint64(w.progSize())
+	phnum := uint64(len(w.f.Progs) + 1)
+	var seg bytes.Buffer
+	seg.Write(make([]byte, phnum*progSize))
+
+	// Loadable segments must be sorted by address, so the new one goes
+	// directly after the last existing one.
+	progs := make([]elf.ProgHeader, 0, phnum)
+	newLoad := -1
+	for _, p := range w.f.Progs {
+		progs = append(progs, p.ProgHeader)
+		if p == lastLoad {
+			newLoad = len(progs)
+			progs = append(progs, elf.ProgHeader{Type: elf.PT_LOAD, Flags: elf.PF_R, Align: pageSize})
+		}
+	}
+
+	var interpOff uint64
+	if interp != nil {
+		if interp.fits() {
+			w.overwriteString(*interp)
+			interp = nil
+		} else {
+			interpOff = uint64(seg.Len())
+			seg.WriteString(interp.newVal)
+			seg.WriteByte(0)
+		}
+	}
+
+	grownPaths := false
+	for _, s := range paths {
+		grownPaths = grownPaths || !s.fits()
+	}
+	var strtabOff, newStrsz uint64
+	newPathOffsets := map[uint64]uint64{}
+	if grownPaths {
+		oldStrtabOff, err := w.vaddrToOffset(strtab)
+		if err != nil {
+			return err
+		}
+		strtabOff = uint64(seg.Len())
+		seg.Write(w.data[oldStrtabOff : oldStrtabOff+strsz])
+		for _, off := range pathOffsets {
+			newPathOffsets[off] = uint64(seg.Len()) - strtabOff
+			seg.WriteString(paths[off].newVal)
+			seg.WriteByte(0)
+		}
+		newStrsz = uint64(seg.Len()) - strtabOff
+	} else {
+		for _, s := range paths {
+			w.overwriteString(*s)
+		}
+	}
+	segSize := uint64(seg.Len())
+
+	for i := range progs {
+		p := &progs[i]
+		switch {
+		case p.Type == elf.PT_PHDR:
+			p.Off, p.Vaddr, p.Paddr = newOff, newVaddr, newVaddr
+			p.Filesz, p.Memsz = phnum*progSize, phnum*progSize
+		case p.Type == elf.PT_INTERP && interp != nil:
+			p.Off, p.Vaddr, p.Paddr = newOff+interpOff, newVaddr+interpOff, newVaddr+interpOff
+			p.Filesz, p.Memsz = uint64(len(interp.newVal)+1), uint64(len(interp.newVal)+1)
+		case i == newLoad:
+			p.Off, p.Vaddr, p.Paddr = newOff, newVaddr, newVaddr
+			p.Filesz, p.Memsz = segSize, segSize
+		}
+	}
+	out := seg.Bytes()
+	for i, p := range progs {
+		w.putProg(out[uint64(i)*progSize:], p)
+	}
+
+	if grownPaths {
+		for _, d := range dyn {
+			switch d.tag {
+			case elf.DT_STRTAB:
+				w.putWord(w.data[d.valOff:], newVaddr+strtabOff)
+			case elf.DT_STRSZ:
+				w.putWord(w.data[d.valOff:], newStrsz)
+			case elf.DT_RPATH, elf.DT_RUNPATH:
+				if off, found := newPathOffsets[d.val]; found {
+					w.putWord(w.data[d.valOff:], off)
+				}
+			}
+		}
+	}
+
+	// Section headers aren't used by the loader, but keep them pointing at
+	// the data they describe so that tools like readelf stay accurate.
+	for i, s := range w.f.Sections {
+		switch {
+		case s.Name == ".interp" && interp != nil:
+			w.putSection(i, newVaddr+interpOff, newOff+interpOff, uint64(len(interp.newVal)+1))
+		case s.Name == ".dynstr" && grownPaths:
+			w.putSection(i, newVaddr+strtabOff, newOff+strtabOff, newStrsz)
+		}
+	}
+
+	if w.is64 {
+		w.order.PutUint64(w.data[32:], newOff)
+		w.order.PutUint16(w.data[56:], uint16(phnum))
+	} else {
+		w.order.PutUint32(w.data[28:], uint32(newOff))
+		w.order.PutUint16(w.data[44:], uint16(phnum))
+	}
+
+	padded := make([]byte, newOff, newOff+segSize)
+	copy(padded, w.data)
+	w.data = append(padded, out...)
+	return nil
+}
+
+func (w *elfRewriter) overwriteString(s elfStringRewrite) {
+	slot := w.data[s.off : s.off+s.size]
+	n := copy(slot, s.newVal)
+	for i := n; i < len(slot); i++ {
+		slot[i] = 0
+	}
+}
+
+type elfDyn struct {
+	tag    elf.DynTag
+	val    uint64
+	valOff uint64 // file offset of the value of this entry
+}
+
+func (w *elfRewriter) dynamicEntries() (entries []elfDyn, err error) {
+	for _, p := range w.f.Progs {
+		if p.Type != elf.PT_DYNAMIC {
+			continue
+		}
+		if p.Off+p.Filesz > uint64(len(w.data)) {
+			return nil, fmt.Errorf("PT_DYNAMIC segment is out of bounds")
+		}
+		word := uint64(w.wordSize())
+		for off := p.Off; off+2*word <= p.Off+p.Filesz; off += 2 * word {
+			d := elfDyn{
+				tag:    elf.DynTag(w.word(w.data[off:])),
+				val:    w.word(w.data[off+word:]),
+				valOff: off + word,
+			}
+			if d.tag == elf.DT_NULL {
+				break
+			}
+			entries = append(entries, d)
+		}
+	}
+	return entries, nil
+}
+
+func (w *elfRewriter) vaddrToOffset(vaddr uint64) (uint64, error) {
+	for _, p := range w.f.Progs {
+		if p.Type == elf.PT_LOAD && vaddr >= p.Vaddr && vaddr < p.Vaddr+p.Filesz {
+			return vaddr - p.Vaddr + p.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address %#x is not within a loadable segment", vaddr)
+}
+
+func (w *elfRewriter) wordSize() int {
+	if w.is64 {
+		return 8
+	}
+	return 4
+}
+
+func (w *elfRewriter) word(b []byte) uint64 {
+	if w.is64 {
+		return w.order.Uint64(b)
+	}
+	return uint64(w.order.Uint32(b))
+}
+
+func (w *elfRewriter) putWord(b []byte, v uint64) {
+	if w.is64 {
+		w.order.PutUint64(b, v)
+		return
+	}
+	w.order.PutUint32(b, uint32(v))
+}
+
+func (w *elfRewriter) progSize() int {
+	if w.is64 {
+		return binary.Size(elf.Prog64{})
+	}
+	return binary.Size(elf.Prog32{})
+}
+
+func (w *elfRewriter) putProg(b []byte, p elf.ProgHeader) {
+	if w.is64 {
+		w.order.PutUint32(b[0:], uint32(p.Type))
+		w.order.PutUint32(b[4:], uint32(p.Flags))
+		w.order.PutUint64(b[8:], p.Off)
+		w.order.PutUint64(b[16:], p.Vaddr)
+		w.order.PutUint64(b[24:], p.Paddr)
+		w.order.PutUint64(b[32:], p.Filesz)
+		w.order.PutUint64(b[40:], p.Memsz)
+		w.order.PutUint64(b[48:], p.Align)
+		return
+	}
+	w.order.PutUint32(b[0:], uint32(p.Type))
+	w.order.PutUint32(b[4:], uint32(p.Off))
+	w.order.PutUint32(b[8:], uint32(p.Vaddr))
+	w.order.PutUint32(b[12:], uint32(p.Paddr))
+	w.order.PutUint32(b[16:], uint32(p.Filesz))
+	w.order.PutUint32(b[20:], uint32(p.Memsz))
+	w.order.PutUint32(b[24:], uint32(p.Flags))
+	w.order.PutUint32(b[28:], uint32(p.Align))
+}
+
+// putSection updates the address, offset and size of the section header at
+// index i.
+func (w *elfRewriter) putSection(i int, addr, off, size uint64) {
+	var shoff, shentsize uint64
+	if w.is64 {
+		shoff = w.order.Uint64(w.data[40:])
+		shentsize = uint64(w.order.Uint16(w.data[58:]))
+	} else {
+		shoff = uint64(w.order.Uint32(w.data[32:]))
+		shentsize = uint64(w.order.Uint16(w.data[46:]))
+	}
+	sh := shoff + uint64(i)*shentsize
+	if shoff == 0 || sh+shentsize > uint64(len(w.data)) {
+		return
+	}
+	b := w.data[sh:]
+	if w.is64 {
+		w.order.PutUint64(b[16:], addr)
+		w.order.PutUint64(b[24:], off)
+		w.order.PutUint64(b[32:], size)
+		return
+	}
+	w.order.PutUint32(b[12:], uint32(addr))
+	w.order.PutUint32(b[16:], uint32(off))
+	w.order.PutUint32(b[20:], uint32(size))
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) / align * align
+}
@@ -0,0 +1,157 @@
+package brewery
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requireLinuxCC(t *testing.T) string {
+	if runtime.GOOS != "linux" {
+		t.Skip("elf relocation is only exercised on linux")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no c compiler available")
+	}
+	return cc
+}
+
+func readInterp(t *testing.T, path string) string {
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			b := make([]byte, p.Filesz)
+			if _, err := p.ReadAt(b, 0); err != nil {
+				t.Fatal(err)
+			}
+			return cString(b)
+		}
+	}
+	return ""
+}
+
+func readRunpath(t *testing.T, path string) []string {
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	runpath, err := f.DynString(elf.DT_RUNPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runpath
+}
+
+func rewriteELFFile(t *testing.T, path string, fn func(string) string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, changed, err := rewriteELF(data, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected file to be changed")
+	}
+	if err := os.WriteFile(path, out, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func buildRelocatableProgram(t *testing.T, dir string) string {
+	cc := requireLinuxCC(t)
+	libDir := filepath.Join(dir, "lib")
+	if err := os.MkdirAll(libDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "foo.c"), []byte("int foo(void) { return 0; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "main.c"), []byte("int foo(void);\nint main(void) { return foo(); }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"-shared", "-fPIC", "-o", filepath.Join(libDir, "libfoo.so"), filepath.Join(src, "foo.c")},
+		{"-o", filepath.Join(dir, "main"), filepath.Join(src, "main.c"),
+			"-L" + libDir, "-lfoo", "-Wl,--enable-new-dtags,-rpath," + prefixPlaceholder + "/lib"},
+	} {
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Skipf("unable to compile test program: %v: %s", err, out)
+		}
+	}
+	return filepath.Join(dir, "main")
+}
+
+func TestRewriteELFRunpath(t *testing.T) {
+	dir := t.TempDir()
+	program := buildRelocatableProgram(t, dir)
+	assert.Equal(t, []string{prefixPlaceholder + "/lib"}, readRunpath(t, program))
+
+	for _, prefix := range []string{"/x", dir} {
+		prefix := prefix
+		t.Run(prefix, func(t *testing.T) {
+			cp := filepath.Join(t.TempDir(), "main")
+			data, _ := os.ReadFile(program)
+			if err := os.WriteFile(cp, data, 0755); err != nil {
+				t.Fatal(err)
+			}
+			rewriteELFFile(t, cp, func(s string) string {
+				return strings.ReplaceAll(s, prefixPlaceholder, prefix)
+			})
+			assert.Equal(t, []string{prefix + "/lib"}, readRunpath(t, cp))
+			if prefix != dir {
+				return
+			}
+			if out, err := exec.Command(cp).CombinedOutput(); err != nil {
+				t.Fatalf("relocated program failed to run: %v: %s", err, out)
+			}
+		})
+	}
+}
+
+func TestRewriteELFInterp(t *testing.T) {
+	program := buildRelocatableProgram(t, t.TempDir())
+	interp := readInterp(t, program)
+	if interp == "" {
+		t.Skip("test program has no interpreter")
+	}
+
+	// Point the interpreter at a symlink with a much longer path so that it
+	// no longer fits in the original segment.
+	dir := filepath.Join(t.TempDir(), strings.Repeat("long-directory-name/", 5))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	newInterp := filepath.Join(dir, "ld.so")
+	if err := os.Symlink(interp, newInterp); err != nil {
+		t.Fatal(err)
+	}
+	rewriteELFFile(t, program, func(s string) string {
+		if s == interp {
+			return newInterp
+		}
+		return strings.ReplaceAll(s, prefixPlaceholder, filepath.Dir(program))
+	})
+	assert.Equal(t, newInterp, readInterp(t, program))
+	assert.Equal(t, []string{filepath.Dir(program) + "/lib"}, readRunpath(t, program))
+	if out, err := exec.Command(program).CombinedOutput(); err != nil {
+		t.Fatalf("relocated program failed to run: %v: %s", err, out)
+	}
+}
@@ -0,0 +1,287 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DependencyCycleError is returned when the runtime dependencies of a set of
+// formulas form a cycle.
+type DependencyCycleError struct {
+	// Cycle lists the formulas in the cycle, starting and ending with the
+	// same formula.
+	Cycle []string
+}
+
+func (e *DependencyCycleError) Error() string {
+	return fmt.Sprintf("dependency cycle: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// depGraph is the runtime dependency graph of a set of formulas. Nodes are
+// keyed by canonical formula name.
+type depGraph struct {
+	roots    []string
+	formulas map[string]Formula
+	deps     map[string][]string
+	// failed holds the formulas whose dependencies couldn't be resolved.
+	failed map[string]error
+	// order is the formulas sorted so that every formula comes after its
+	// dependencies.
+	order []string
+	// resolutions holds the names other than its own, like aliases and old
+	// names, that each formula was requested or depended on by.
+	resolutions map[string][]Resolution
+}
+
+// addResolutions records the resolutions of names that weren't canonical.
+func (g *depGraph) addResolutions(resolved []Resolution) {
+	for _, r := range resolved {
+		if r.Requested == r.Name {
+			continue
+		}
+		if g.resolutions == nil {
+			g.resolutions = map[string][]Resolution{}
+		}
+		known := false
+		for _, e := range g.resolutions[r.Name] {
+			known = known || e == r
+		}
+		if !known {
+			g.resolutions[r.Name] = append(g.resolutions[r.Name], r)
+		}
+	}
+}
+
+// directDependencies returns the names of the formulas that formula depends
+// on directly. The tab in the bottle manifest is used when it records which
+// runtime dependencies were declared directly, otherwise the dependencies
+// listed in the formula index are.
+func (b *Brewery) directDependencies(ctx context.Context, formula Formula) ([]string, error) {
+	m, err := b.DownloadManifest(ctx, formula)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
+	}
+	tb, err := m.TabForCurrentOS()
+	if err != nil {
+		return nil, fmt.Errorf("error fetching information about the current os: %w", err)
+	}
+	var deps []string
+	for _, d := range tb.RuntimeDependencies {
+		if d.DeclaredDirectly {
+			deps = append(deps, d.FullName)
+		}
+	}
+	// Older tabs either don't list runtime dependencies at all or don't
+	// record which of them were declared directly.
+	if len(deps) == 0 && (tb.RuntimeDependencies == nil || len(tb.RuntimeDependencies) > 0) {
+		deps = formula.Dependencies
+	}
+	return deps, nil
+}
+
+// dependencyGraph resolves names and all of their transitive runtime
+// dependencies. Any formula that can't be resolved is an error.
+func (b *Brewery) dependencyGraph(ctx context.Context, names ...string) (g *depGraph, err error) {
+	g, missing, err := b.resolveGraph(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	if b.offline {
+		if err := b.missingArtifacts(g); err != nil {
+			return nil, err
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &MissingFormulasError{Names: missing}
+	}
+	for _, name := range g.order {
+		if err := g.failed[name]; err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// resolveGraph resolves names and all of their transitive runtime
+// dependencies. Manifests are fetched a level of the graph at a time.
+// Requested names that don't exist are returned in missing and formulas whose
+// dependencies couldn't be determined are recorded in g.failed, neither stops
+// the rest of the graph from being resolved. With a lockfile the graph comes
+// from the lockfile instead.
+func (b *Brewery) resolveGraph(ctx context.Context, names ...string) (g *depGraph, missing []string, err error) {
+	if b.lockfile != nil {
+		g, err := b.lockedGraph(ctx, names...)
+		return g, nil, err
+	}
+	ctx, span := networkTracer.Start(ctx, "brewery.dependencyGraph")
+	defer span.End()
+
+	g = &depGraph{
+		formulas: map[string]Formula{},
+		deps:     map[string][]string{},
+		failed:   map[string]error{},
+	}
+	roots, resolved, missing, err := b.resolveFormulas(ctx, names...)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.addResolutions(resolved)
+	for _, f := range roots {
+		g.roots = append(g.roots, f.Name)
+	}
+
+	frontier := roots
+	for len(frontier) > 0 {
+		for _, f := range frontier {
+			g.formulas[f.Name] = f
+		}
+		direct := make([][]string, len(frontier))
+		errs := make([]error, len(frontier))
+		sem := make(chan struct{}, b.pipeline.withDefaults().Manifests)
+		var wg sync.WaitGroup
+		for i, f := range frontier {
+			i, f := i, f
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				direct[i], errs[i] = b.directDependencies(ctx, f)
+			}()
+		}
+		wg.Wait()
+
+		var next []Formula
+		for i, f := range frontier {
+			if errs[i] != nil {
+				g.failed[f.Name] = errs[i]
+				continue
+			}
+			formulas, resolved, missing, err := b.resolveFormulas(ctx, direct[i]...)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(missing) > 0 {
+				g.failed[f.Name] = fmt.Errorf("error finding dependencies of %s: %w",
+					f.Name, &MissingFormulasError{Names: missing})
+				continue
+			}
+			g.addResolutions(resolved)
+			for _, r := range resolved {
+				g.deps[f.Name] = appendUnique(g.deps[f.Name], r.Name)
+			}
+			for _, dep := range formulas {
+				if _, found := g.formulas[dep.Name]; found {
+					continue
+				}
+				g.formulas[dep.Name] = dep
+				next = append(next, dep)
+			}
+		}
+		frontier = next
+	}
+	if g.order, err = g.sort(); err != nil {
+		return nil, nil, err
+	}
+	return g, missing, nil
+}
+
+// sort orders the graph depth first from the roots so that dependencies come
+// before their dependents.
+func (g *depGraph) sort() (order []string, err error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, n := range stack {
+				if n == name {
+					cycle := append(append([]string{}, stack[i:]...), name)
+					return &DependencyCycleError{Cycle: cycle}
+				}
+			}
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range g.deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, root := range g.roots {
+		if err := visit(root); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// sorted returns the formulas of the graph with dependencies first.
+func (g *depGraph) sorted() []Formula {
+	return mapSlice(g.order, func(name string) Formula { return g.formulas[name] })
+}
+
+func (g *depGraph) isRoot(name string) bool {
+	for _, root := range g.roots {
+		if root == name {
+			return true
+		}
+	}
+	return false
+}
+
+// DependencyFailedError is returned for a formula that wasn't installed
+// because one of its dependencies failed to install.
+type DependencyFailedError struct {
+	Name       string
+	Dependency string
+}
+
+func (e *DependencyFailedError) Error() string {
+	return fmt.Sprintf("skipped %s because its dependency %s failed to install", e.Name, e.Dependency)
+}
+
+// firstError returns the error of the first formula in install order that
+// failed for a reason other than a dependency failing or being cancelled.
+func (g *depGraph) firstError(errs map[string]error) error {
+	var fallback error
+	for _, name := range g.order {
+		err := errs[name]
+		var depErr *DependencyFailedError
+		switch {
+		case err == nil:
+		case errors.As(err, &depErr), errors.Is(err, context.Canceled):
+			if fallback == nil {
+				fallback = err
+			}
+		default:
+			return err
+		}
+	}
+	return fallback
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
@@ -0,0 +1,249 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyGraph(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t,
+		testBottle{name: "app", version: "1.0", deps: []string{"liba", "libb"}},
+		testBottle{name: "liba", version: "1.0", deps: []string{"libc"}},
+		// The formula index is used when the tab doesn't say which
+		// dependencies were declared directly.
+		testBottle{name: "libb", version: "1.0", deps: []string{"libc"}, undeclared: true},
+		testBottle{name: "libc", version: "1.0"},
+	)
+	b := reg.brewery(t)
+
+	g, err := b.dependencyGraph(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"libc", "liba", "libb", "app"}, g.order)
+	assert.Equal(t, []string{"libc"}, g.deps["libb"])
+	assert.True(t, g.isRoot("app"))
+	assert.False(t, g.isRoot("libc"))
+
+	if err := b.Install(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range g.order {
+		r, err := ReadReceipt(b.cellar(name, "1.0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, name == "app", r.InstalledOnRequest, name)
+	}
+}
+
+func TestDependencyGraphCycle(t *testing.T) {
+	reg := newTestRegistry(t,
+		testBottle{name: "foo", version: "1.0", deps: []string{"bar"}},
+		testBottle{name: "bar", version: "1.0", deps: []string{"baz"}},
+		testBottle{name: "baz", version: "1.0", deps: []string{"bar"}},
+	)
+	b := reg.brewery(t)
+
+	_, err := b.dependencyGraph(context.Background(), "foo")
+	var cycleErr *DependencyCycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("expected a DependencyCycleError, got %v", err)
+	}
+	assert.Equal(t, []string{"bar", "baz", "bar"}, cycleErr.Cycle)
+}
+
+func TestPipelineWaitsForDependencies(t *testing.T) {
+	g := &depGraph{
+		roots:    []string{"app"},
+		formulas: map[string]Formula{},
+		deps: map[string][]string{
+			"app":  {"liba", "libb"},
+			"liba": {"libc"},
+			"libb": {"libc"},
+		},
+	}
+	for _, name := range []string{"app", "liba", "libb", "libc"} {
+		g.formulas[name] = Formula{Name: name}
+	}
+	var err error
+	if g.order, err = g.sort(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	poured := map[string]bool{}
+	errs := g.runPipeline(context.Background(), []pipelineStage{
+		{name: "fetch", workers: 2, fn: func(ctx context.Context, f Formula) error { return nil }},
+	}, pipelineStage{name: "link", workers: 2, fn: func(ctx context.Context, f Formula) error {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, dep := range g.deps[f.Name] {
+			if !poured[dep] {
+				t.Errorf("%s poured before its dependency %s", f.Name, dep)
+			}
+		}
+		poured[f.Name] = true
+		return nil
+	}}, false)
+	assert.Empty(t, errs)
+	assert.Len(t, poured, 4)
+
+	// A failure skips the dependents but not unrelated formulas.
+	g.roots = append(g.roots, "other")
+	g.formulas["other"] = Formula{Name: "other"}
+	if g.order, err = g.sort(); err != nil {
+		t.Fatal(err)
+	}
+	poured = map[string]bool{}
+	errs = g.runPipeline(context.Background(), []pipelineStage{
+		{name: "fetch", workers: 2, fn: func(ctx context.Context, f Formula) error { return nil }},
+		{name: "extract", workers: 1, fn: func(ctx context.Context, f Formula) error {
+			if f.Name == "liba" {
+				return os.ErrNotExist
+			}
+			return nil
+		}},
+	}, pipelineStage{name: "link", workers: 2, fn: func(ctx context.Context, f Formula) error {
+		lock.Lock()
+		defer lock.Unlock()
+		poured[f.Name] = true
+		return nil
+	}}, false)
+	assert.Equal(t, map[string]bool{"libc": true, "libb": true, "other": true}, poured)
+	assert.Len(t, errs, 2)
+	assert.ErrorIs(t, errs["liba"], os.ErrNotExist)
+	var depErr *DependencyFailedError
+	if assert.ErrorAs(t, errs["app"], &depErr) {
+		assert.Equal(t, "liba", depErr.Dependency)
+	}
+	assert.ErrorIs(t, g.firstError(errs), os.ErrNotExist)
+}
+
+func TestInstallMany(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t,
+		testBottle{name: "lib", version: "1.0"},
+		testBottle{name: "broken", version: "1.0"},
+		testBottle{name: "app1", version: "1.0", deps: []string{"lib"}},
+		testBottle{name: "app2", version: "1.0", deps: []string{"lib", "broken"}},
+	)
+	b := reg.brewery(t)
+	brokenBottle := "/v2/homebrew/core/broken/blobs/"
+	reg.lock.Lock()
+	for path := range reg.blobs {
+		if strings.HasPrefix(path, brokenBottle) {
+			delete(reg.blobs, path)
+		}
+	}
+	reg.lock.Unlock()
+
+	results, err := b.InstallMany(ctx, []string{"app1", "app2", "nope"}, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]InstallResult{}
+	for _, r := range results {
+		byName[r.Name] = r
+	}
+	assert.Len(t, results, 5)
+	assert.NoError(t, byName["lib"].Err)
+	assert.NoError(t, byName["app1"].Err)
+	assert.True(t, byName["app1"].Requested)
+	assert.False(t, byName["lib"].Requested)
+	assert.Error(t, byName["broken"].Err)
+	var depErr *DependencyFailedError
+	assert.ErrorAs(t, byName["app2"].Err, &depErr)
+	var missingErr *MissingFormulasError
+	assert.ErrorAs(t, byName["nope"].Err, &missingErr)
+
+	for path, n := range reg.requests {
+		if strings.HasPrefix(path, "/v2/homebrew/core/lib/blobs/") {
+			assert.Equal(t, 1, n, "shared bottle should be downloaded once")
+		}
+	}
+	for _, keg := range []string{"lib/1.0", "app1/1.0"} {
+		if _, err := os.Stat(b.cellar(keg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(b.cellar("app2")); !os.IsNotExist(err) {
+		t.Fatalf("expected app2 not to be installed: %v", err)
+	}
+}
+
+func TestInstallManyCorruptBottle(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t,
+		testBottle{name: "broken", version: "1.0"},
+		testBottle{name: "app", version: "1.0", deps: []string{"broken"}},
+	)
+	b := reg.brewery(t)
+	formulas, err := b.findFormulas(ctx, "broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := b.cachedBottle(formulas[0])
+	if err := os.WriteFile(loc, []byte("not a bottle"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := b.InstallMany(ctx, []string{"app"}, InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "broken", results[0].Name)
+		assert.ErrorContains(t, results[0].Err, "error extracting bottle for broken")
+		var depErr *DependencyFailedError
+		assert.ErrorAs(t, results[1].Err, &depErr)
+	}
+	if _, err := os.Stat(b.unpackedBottle(formulas[0])); !os.IsNotExist(err) {
+		t.Fatalf("expected the partial bottle to be removed: %v", err)
+	}
+}
+
+func TestInstallOverLeftoverBottle(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, testBottle{
+		name: "foo", version: "1.0",
+		files:    map[string]string{"share/foo/README": "read only\n"},
+		modes:    map[string]int64{"share/foo/README": 0444},
+		symlinks: map[string]string{"bin/foo-link": "foo"},
+	})
+	b := reg.brewery(t)
+	formulas, err := b.findFormulas(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A run that failed after extracting leaves the unpacked bottle behind.
+	if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.extract(formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Install(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Readlink(filepath.Join(b.cellar("foo", "1.0"), "bin", "foo-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "foo", target)
+	if _, err := os.Stat(filepath.Join(b.cellar("foo", "1.0"), "share", "foo", "README")); err != nil {
+		t.Fatal(err)
+	}
+}
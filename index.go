@@ -0,0 +1,299 @@
+package brewery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/maxmcd/brewery/internal/atomicfile"
+)
+
+// coreTap is the tap that every formula in formula.json belongs to.
+const coreTap = "homebrew/core"
+
+// Resolution describes how a requested name was resolved to a formula.
+type Resolution struct {
+	Requested string
+	// Name is the canonical name of the formula.
+	Name string
+	// Alias is set if Requested is an alias of the formula.
+	Alias bool
+	// Renamed is set if Requested is an old name of the formula.
+	Renamed bool
+}
+
+// indexEntry is the byte offset and length of a formula object within
+// formula.json.
+type indexEntry [2]int64
+
+// formulaIndex maps names to the location of their formula within
+// formula.json so that single formulas can be decoded without reading the
+// whole file. It is stored next to formula.json and is only valid for the
+// file with the recorded size and modification time.
+type formulaIndex struct {
+	Size     int64                 `json:"size"`
+	ModTime  int64                 `json:"mod_time"`
+	Names    map[string]indexEntry `json:"names"`
+	Aliases  map[string]indexEntry `json:"aliases"`
+	Oldnames map[string]indexEntry `json:"oldnames"`
+}
+
+func (idx *formulaIndex) validFor(fi os.FileInfo) bool {
+	return idx != nil && idx.Size == fi.Size() && idx.ModTime == fi.ModTime().UnixNano()
+}
+
+// lookup finds the formula for name. Formula names take precedence over
+// aliases, which take precedence over old names. Names qualified with the
+// homebrew/core tap are looked up without it.
+func (idx *formulaIndex) lookup(name string) (e indexEntry, r Resolution, found bool) {
+	r.Requested = name
+	name = strings.TrimPrefix(name, coreTap+"/")
+	if e, found = idx.Names[name]; found {
+		return e, r, true
+	}
+	if e, found = idx.Aliases[name]; found {
+		r.Alias = true
+		return e, r, true
+	}
+	if e, found = idx.Oldnames[name]; found {
+		r.Renamed = true
+		return e, r, true
+	}
+	return e, r, false
+}
+
+// buildFormulaIndex scans the formula list in r and records where each
+// formula object starts and ends.
+func buildFormulaIndex(ctx context.Context, r io.Reader) (idx *formulaIndex, err error) {
+	_, span := diskTracer.Start(ctx, "brewery.buildFormulaIndex")
+	defer span.End()
+
+	idx = &formulaIndex{
+		Names:    map[string]indexEntry{},
+		Aliases:  map[string]indexEntry{},
+		Oldnames: map[string]indexEntry{},
+	}
+	var pos int64
+	scanner := bufio.NewScanner(r)
+	// Formula objects are a few kilobytes, but some are much larger.
+	scanner.Buffer(make([]byte, 0, 256*1024), 16*1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = jsonObjectSplitFunc(data, atEOF)
+		pos += int64(advance)
+		return advance, token, err
+	})
+	for scanner.Scan() {
+		token := scanner.Bytes()
+		// The token always ends where the split function advanced to.
+		e := indexEntry{pos - int64(len(token)), int64(len(token))}
+		var names struct {
+			Name     string   `json:"name"`
+			FullName string   `json:"full_name"`
+			Oldname  string   `json:"oldname"`
+			Oldnames []string `json:"oldnames"`
+			Aliases  []string `json:"aliases"`
+		}
+		if err := json.Unmarshal(token, &names); err != nil {
+			return nil, fmt.Errorf("error decoding formula at offset %d: %w", e[0], err)
+		}
+		idx.Names[names.Name] = e
+		if names.FullName != "" {
+			idx.Names[names.FullName] = e
+		}
+		for _, alias := range names.Aliases {
+			idx.Aliases[alias] = e
+		}
+		if names.Oldname != "" {
+			idx.Oldnames[names.Oldname] = e
+		}
+		for _, oldname := range names.Oldnames {
+			idx.Oldnames[oldname] = e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning formula list: %w", err)
+	}
+	return idx, nil
+}
+
+func (b *Brewery) formulaIndexPath() string { return b.cache("api", "formula.json.index") }
+
+// readFormulaIndex reads the index from disk, returning nil if it is missing,
+// unreadable or doesn't match fi.
+func (b *Brewery) readFormulaIndex(fi os.FileInfo) *formulaIndex {
+	f, err := os.Open(b.formulaIndexPath())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var idx formulaIndex
+	if err := json.NewDecoder(bufio.NewReader(f)).Decode(&idx); err != nil || !idx.validFor(fi) {
+		return nil
+	}
+	return &idx
+}
+
+// writeFormulaIndex stamps idx with fi and writes it to disk.
+func (b *Brewery) writeFormulaIndex(idx *formulaIndex, fi os.FileInfo) error {
+	idx.Size, idx.ModTime = fi.Size(), fi.ModTime().UnixNano()
+	v, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("error encoding formula index: %w", err)
+	}
+	if err := atomicfile.WriteFile(b.formulaIndexPath(), bytes.NewReader(v), nil); err != nil {
+		return fmt.Errorf("error writing formula index: %w", err)
+	}
+	b.indexLock.Lock()
+	b.index = idx
+	b.indexLock.Unlock()
+	return nil
+}
+
+// formulaIndex returns the index for the opened formula.json in f, reading
+// it from memory or disk if it is up to date and rebuilding it otherwise.
+func (b *Brewery) formulaIndex(ctx context.Context, f *os.File) (*formulaIndex, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error checking formula list: %w", err)
+	}
+	b.indexLock.Lock()
+	idx := b.index
+	b.indexLock.Unlock()
+	if idx.validFor(fi) {
+		return idx, nil
+	}
+	if idx = b.readFormulaIndex(fi); idx != nil {
+		b.indexLock.Lock()
+		b.index = idx
+		b.indexLock.Unlock()
+		return idx, nil
+	}
+	if idx, err = buildFormulaIndex(ctx, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return nil, err
+	}
+	if err := b.writeFormulaIndex(idx, fi); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// lookupFormulas decodes the formulas with the given names from the cached
+// formula.json, returning them in the order requested along with any names
+// that weren't found. Names that resolve to the same formula are only
+// returned once.
+func (b *Brewery) lookupFormulas(ctx context.Context, names ...string) (formulas []Formula, missing []string, err error) {
+	formulas, _, missing, err = b.resolveFormulas(ctx, names...)
+	return formulas, missing, err
+}
+
+// resolveFormulas is lookupFormulas but also returns the resolution of every
+// name that was found. Names may be formula names, aliases, old names or be
+// qualified with the homebrew/core tap.
+func (b *Brewery) resolveFormulas(ctx context.Context, names ...string) (
+	formulas []Formula, resolved []Resolution, missing []string, err error,
+) {
+	f, err := b.openOrDownloadAllFormulas(ctx)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error opening or downloading all formulas: %w", err)
+	}
+	defer f.Close()
+	idx, err := b.formulaIndex(ctx, f)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, span := diskTracer.Start(ctx, "brewery.lookupFormulas")
+	defer span.End()
+	seen := map[indexEntry]string{}
+	for _, name := range names {
+		e, r, found := idx.lookup(name)
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		if canonical, found := seen[e]; found {
+			r.Name = canonical
+			resolved = append(resolved, r)
+			continue
+		}
+		buf := make([]byte, e[1])
+		if _, err := f.ReadAt(buf, e[0]); err != nil {
+			return nil, nil, nil, fmt.Errorf("error reading formula %s: %w", name, err)
+		}
+		var formula Formula
+		if err := json.Unmarshal(buf, &formula); err != nil {
+			return nil, nil, nil, fmt.Errorf("error decoding formula %s: %w", name, err)
+		}
+		seen[e] = formula.Name
+		r.Name = formula.Name
+		resolved = append(resolved, r)
+		formulas = append(formulas, formula)
+	}
+	return formulas, resolved, missing, nil
+}
+
+// rawFormulas returns the objects for the formulas with the given canonical
+// names exactly as they appear in formula.json.
+func (b *Brewery) rawFormulas(ctx context.Context, names ...string) ([]json.RawMessage, error) {
+	f, err := b.openOrDownloadAllFormulas(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error opening or downloading all formulas: %w", err)
+	}
+	defer f.Close()
+	idx, err := b.formulaIndex(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	var formulas []json.RawMessage
+	for _, name := range names {
+		e, found := idx.Names[name]
+		if !found {
+			return nil, &MissingFormulasError{Names: []string{name}}
+		}
+		buf := make([]byte, e[1])
+		if _, err := f.ReadAt(buf, e[0]); err != nil {
+			return nil, fmt.Errorf("error reading formula %s: %w", name, err)
+		}
+		formulas = append(formulas, buf)
+	}
+	return formulas, nil
+}
+
+// MissingFormulasError is returned when names don't resolve to any formula.
+type MissingFormulasError struct {
+	Names []string
+}
+
+func (e *MissingFormulasError) Error() string {
+	return fmt.Sprintf("missing formulas: %v", e.Names)
+}
+
+// Resolve maps each of names, which may be formula names, aliases, old names
+// or be qualified with the homebrew/core tap, to the canonical formula name.
+func (b *Brewery) Resolve(ctx context.Context, names ...string) ([]Resolution, error) {
+	_, resolved, missing, err := b.resolveFormulas(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, &MissingFormulasError{Names: missing}
+	}
+	return resolved, nil
+}
+
+// findFormulas is lookupFormulas but missing formulas are an error.
+func (b *Brewery) findFormulas(ctx context.Context, names ...string) (formulas []Formula, err error) {
+	formulas, missing, err := b.lookupFormulas(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, &MissingFormulasError{Names: missing}
+	}
+	return formulas, nil
+}
@@ -0,0 +1,46 @@
+// Package atomicfile writes files so that readers see either the old file
+// or the complete new one.
+package atomicfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile streams r into a temporary file next to filename and
+// renames it into place once it has been completely written, so that readers
+// never see a partial file. If verify is not nil it is called before the
+// rename and an error leaves filename untouched.
+func WriteFile(filename string, r io.Reader, verify func() error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %q: %w", filename, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("error writing to file %q: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing file %q: %w", f.Name(), err)
+	}
+	if verify != nil {
+		if err := verify(); err != nil {
+			return err
+		}
+	}
+	// CreateTemp creates files that only the owner can read.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("error setting permissions of %q: %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %w", f.Name(), filename, err)
+	}
+	return nil
+}
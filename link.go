@@ -0,0 +1,295 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// linkDirs are the keg directories that are linked into the prefix.
+var linkDirs = []string{"etc", "bin", "sbin", "include", "share", "lib", "Frameworks"}
+
+// skipLinking lists files, relative to the keg, that brew never links because
+// they are shared by every keg that ships them.
+var skipLinking = map[string]struct{}{
+	"lib/charset.alias":         {},
+	"share/locale/locale.alias": {},
+	"share/info/dir":            {},
+}
+
+type LinkOptions struct {
+	// DryRun returns the links that would be created without touching the
+	// filesystem.
+	DryRun bool
+	// Overwrite replaces any conflicting files in the prefix.
+	Overwrite bool
+}
+
+// LinkConflictError is returned when files in the prefix that don't belong to
+// the keg being linked are in the way.
+type LinkConflictError struct {
+	Name      string
+	Conflicts []string
+}
+
+func (e *LinkConflictError) Error() string {
+	return fmt.Sprintf("could not link %s, the following files already exist: %s",
+		e.Name, strings.Join(e.Conflicts, ", "))
+}
+
+func (b *Brewery) opt(a ...string) string {
+	return filepath.Join(append([]string{b.prefix, "opt"}, a...)...)
+}
+
+func (b *Brewery) linkedKegs(a ...string) string {
+	return filepath.Join(append([]string{b.prefix, "var", "homebrew", "linked"}, a...)...)
+}
+
+func (b *Brewery) unpackedKeg(formula Formula) string {
+	return filepath.Join(b.unpackedBottle(formula), formula.Name, formula.pkgVersion())
+}
+
+// Link pours the unpacked bottle for formula into the Cellar and symlinks the
+// contents of the keg into the prefix. Keg-only formulas are poured and
+// given an opt link, but nothing else is linked.
+//
+// Directories in the prefix are created as needed and every file is linked
+// individually, so kegs can share directories like lib/pkgconfig. Existing
+// links that point into another version of the same formula are replaced.
+// The paths of the links that were created (or would be, with DryRun) are
+// returned.
+func (b *Brewery) Link(ctx context.Context, formula Formula, opts LinkOptions) (links []string, err error) {
+	_, span := diskTracer.Start(ctx, "Link "+formula.Name)
+	defer span.End()
+
+	keg := b.cellar(formula.Name, formula.pkgVersion())
+	src := keg
+	if _, err := os.Stat(keg); os.IsNotExist(err) {
+		src = b.unpackedKeg(formula)
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("bottle for %s has not been unpacked: %w", formula.Name, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("error checking for keg %q: %w", keg, err)
+	}
+
+	optLink := plannedLink{dst: b.opt(formula.Name), target: keg}
+	planned := []plannedLink{optLink}
+	var dirs []string
+	if !formula.KegOnly {
+		dirs, planned, err = b.planLinks(formula, src, keg, opts, planned)
+		if err != nil {
+			return nil, err
+		}
+		planned = append(planned, plannedLink{dst: b.linkedKegs(formula.Name), target: keg})
+	}
+	for _, l := range planned {
+		links = append(links, l.dst)
+	}
+	if opts.DryRun {
+		return links, nil
+	}
+
+	if src != keg {
+		if err := b.pour(src, keg); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range append(dirs, b.opt(), b.linkedKegs()) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating dir %q: %w", dir, err)
+		}
+	}
+	for _, l := range planned {
+		if err := l.create(); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
+
+// pour moves an unpacked keg into the Cellar.
+func (b *Brewery) pour(src, keg string) error {
+	if err := os.MkdirAll(filepath.Dir(keg), 0755); err != nil {
+		return fmt.Errorf("error creating dir %q: %w", filepath.Dir(keg), err)
+	}
+	err := os.Rename(src, keg)
+	if errors.Is(err, syscall.EXDEV) {
+		// The cache and the prefix are on different filesystems.
+		if err = copyDir(src, keg); err == nil {
+			err = os.RemoveAll(src)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error pouring %q into %q: %w", src, keg, err)
+	}
+	return nil
+}
+
+type plannedLink struct {
+	dst    string
+	target string
+}
+
+// create makes a relative symlink at dst pointing at target, replacing
+// anything that is already there.
+func (l plannedLink) create() error {
+	rel, err := filepath.Rel(filepath.Dir(l.dst), l.target)
+	if err != nil {
+		return fmt.Errorf("error finding relative path from %q to %q: %w", l.dst, l.target, err)
+	}
+	if err := os.Remove(l.dst); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %q: %w", l.dst, err)
+	}
+	if err := os.Symlink(rel, l.dst); err != nil {
+		return fmt.Errorf("error symlinking %q to %q: %w", rel, l.dst, err)
+	}
+	return nil
+}
+
+// planLinks walks the link directories of the keg contents in src and works
+// out which directories need creating and which links need to be made to keg.
+func (b *Brewery) planLinks(
+	formula Formula, src, keg string, opts LinkOptions, planned []plannedLink,
+) (dirs []string, links []plannedLink, err error) {
+	links = planned
+	var conflicts []string
+	for _, linkDir := range linkDirs {
+		root := filepath.Join(src, linkDir)
+		if _, err := os.Lstat(root); os.IsNotExist(err) {
+			continue
+		}
+		if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(src, path)
+			dst := filepath.Join(b.prefix, rel)
+			if d.IsDir() {
+				if path != root && (linkDir == "bin" || linkDir == "sbin") {
+					return filepath.SkipDir
+				}
+				fi, err := os.Lstat(dst)
+				switch {
+				case os.IsNotExist(err):
+					dirs = append(dirs, dst)
+				case err != nil:
+					return err
+				case !fi.IsDir():
+					conflicts = append(conflicts, dst)
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if _, skip := skipLinking[filepath.ToSlash(rel)]; skip {
+				return nil
+			}
+			fi, err := os.Lstat(dst)
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				return err
+			case fi.IsDir():
+				conflicts = append(conflicts, dst)
+				return nil
+			case opts.Overwrite || formula.linkOverwrite(rel):
+			case fi.Mode()&os.ModeSymlink == 0 || !b.linksIntoFormula(dst, formula):
+				conflicts = append(conflicts, dst)
+				return nil
+			}
+			links = append(links, plannedLink{dst: dst, target: filepath.Join(keg, rel)})
+			return nil
+		}); err != nil {
+			return nil, nil, fmt.Errorf("error walking %q: %w", root, err)
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, nil, &LinkConflictError{Name: formula.Name, Conflicts: conflicts}
+	}
+	return dirs, links, nil
+}
+
+// linksIntoFormula reports whether the symlink at path points into a keg of
+// any version of formula.
+func (b *Brewery) linksIntoFormula(path string, formula Formula) bool {
+	return symlinkPointsInto(path, b.cellar(formula.Name))
+}
+
+// symlinkPointsInto reports whether path is a symlink pointing at or into dir.
+func symlinkPointsInto(path, dir string) bool {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	target = filepath.Clean(target)
+	return target == dir || strings.HasPrefix(target, dir+string(filepath.Separator))
+}
+
+// linkOverwrite reports whether the formula is allowed to overwrite the file
+// at rel, a path relative to the prefix.
+func (f Formula) linkOverwrite(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range f.LinkOverwrite {
+		if ok, _ := filepath.Match(pattern, rel); ok {
+			return true
+		}
+		// Patterns can also name a directory to overwrite everything within.
+		if strings.HasPrefix(rel, strings.TrimSuffix(pattern, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// copyDir recursively copies src to dst preserving symlinks and permissions.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return copyFile(path, target, fi.Mode().Perm())
+		}
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
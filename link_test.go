@@ -0,0 +1,125 @@
+package brewery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFiles(t *testing.T, dir string, files ...string) {
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func linkTestFormula(t *testing.T, extra string) Formula {
+	var f Formula
+	if err := json.Unmarshal([]byte(`{"name": "foo", "versions": {"stable": "1.0"}, "revision": 1`+extra+`}`), &f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func newLinkTestBrewery(t *testing.T, f Formula) *Brewery {
+	b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+	writeTestFiles(t, b.unpackedKeg(f),
+		"bin/foo", "bin/nested/skipped", "lib/libfoo.so", "lib/pkgconfig/foo.pc",
+		"lib/charset.alias", "share/man/man1/foo.1", "README")
+	return b
+}
+
+func TestLink(t *testing.T) {
+	ctx := context.Background()
+	f := linkTestFormula(t, "")
+	b := newLinkTestBrewery(t, f)
+
+	links, err := b.Link(ctx, f, LinkOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, links, filepath.Join(b.prefix, "bin/foo"))
+	assert.NotContains(t, links, filepath.Join(b.prefix, "bin/nested/skipped"))
+	assert.NotContains(t, links, filepath.Join(b.prefix, "lib/charset.alias"))
+	if _, err := os.Stat(b.cellar("foo")); !os.IsNotExist(err) {
+		t.Fatalf("dry run should not pour the keg: %v", err)
+	}
+
+	created, err := b.Link(ctx, f, LinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, links, created)
+	keg := b.cellar("foo", "1.0_1")
+	for _, name := range []string{"bin/foo", "lib/pkgconfig/foo.pc", "share/man/man1/foo.1"} {
+		target, err := os.Readlink(filepath.Join(b.prefix, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, filepath.Join(keg, name), filepath.Join(b.prefix, filepath.Dir(name), target))
+	}
+	target, err := os.Readlink(b.opt("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "../Cellar/foo/1.0_1", target)
+	if _, err := os.Lstat(filepath.Join(b.prefix, "README")); !os.IsNotExist(err) {
+		t.Fatalf("files outside of the link directories should not be linked: %v", err)
+	}
+
+	// Linking again is a no-op.
+	if _, err := b.Link(ctx, f, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkConflicts(t *testing.T) {
+	ctx := context.Background()
+	f := linkTestFormula(t, "")
+	b := newLinkTestBrewery(t, f)
+	writeTestFiles(t, b.prefix, "bin/foo")
+
+	_, err := b.Link(ctx, f, LinkOptions{})
+	var conflict *LinkConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+	assert.Equal(t, []string{filepath.Join(b.prefix, "bin/foo")}, conflict.Conflicts)
+	if _, err := os.Stat(b.cellar("foo")); !os.IsNotExist(err) {
+		t.Fatalf("keg should not be poured when linking conflicts: %v", err)
+	}
+
+	f = linkTestFormula(t, `, "link_overwrite": ["bin/foo"]`)
+	if _, err := b.Link(ctx, f, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Readlink(filepath.Join(b.prefix, "bin/foo")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkKegOnly(t *testing.T) {
+	f := linkTestFormula(t, `, "keg_only": true`)
+	b := newLinkTestBrewery(t, f)
+	links, err := b.Link(context.Background(), f, LinkOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{b.opt("foo")}, links)
+	if _, err := os.Stat(b.cellar("foo", "1.0_1", "bin", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(b.prefix, "bin")); !os.IsNotExist(err) {
+		t.Fatalf("keg-only formula should not be linked: %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package brewery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/maxmcd/brewery/internal/atomicfile"
+)
+
+// LockfileName is the conventional name of a lockfile.
+const LockfileName = "brewery.lock"
+
+const lockfileVersion = 1
+
+// Lockfile pins a closure of formulas to exact bottles so that installs with
+// OptionWithLockfile get byte-identical kegs, however formula.json has
+// changed since the lockfile was written.
+type Lockfile struct {
+	Version  int             `json:"lockfile_version"`
+	Formulas []LockedFormula `json:"formulas"`
+}
+
+// LockedFormula is a formula pinned to a single bottle.
+type LockedFormula struct {
+	Name string `json:"name"`
+	// Version is the annotated version, the stable version followed by the
+	// revision and bottle rebuild, eg: "3.2.2_1-1".
+	Version  string `json:"version"`
+	Revision int    `json:"revision,omitempty"`
+	Rebuild  int    `json:"rebuild,omitempty"`
+	// BottleTag is the os the bottle was built for, eg: "x86_64_linux".
+	BottleTag string `json:"bottle_tag"`
+	Cellar    string `json:"cellar"`
+	// URL is the bottle URL as listed in formula.json, mirrors set with
+	// OptionWithArtifactDomain are applied when installing.
+	URL          string   `json:"url"`
+	Sha256       string   `json:"sha256"`
+	Dependencies []string `json:"dependencies,omitempty"`
+}
+
+// stable returns the stable version, Version without the revision and
+// rebuild, or false if they don't match the ones in Version.
+func (l LockedFormula) stable() (string, bool) {
+	v, ok := l.Version, true
+	if l.Rebuild != 0 {
+		v, ok = strings.CutSuffix(v, fmt.Sprintf("-%d", l.Rebuild))
+	}
+	if ok && l.Revision != 0 {
+		v, ok = strings.CutSuffix(v, fmt.Sprintf("_%d", l.Revision))
+	}
+	return v, ok && v != ""
+}
+
+// formula returns base, the formula as it is in formula.json, pinned to the
+// locked bottle.
+func (l LockedFormula) formula(base Formula) Formula {
+	f := base
+	f.Name = l.Name
+	if f.FullName == "" {
+		f.FullName = l.Name
+	}
+	f.Versions.Stable, _ = l.stable()
+	f.Revision = l.Revision
+	f.Dependencies = l.Dependencies
+	if i := strings.LastIndex(l.URL, "/"+strings.Replace(l.Name, "@", "/", 1)+"/blobs/"); i > 0 {
+		f.Bottle.Stable.RootURL = l.URL[:i]
+	}
+	f.Bottle.Stable.Rebuild = l.Rebuild
+	f.Bottle.Stable.Files = map[string]struct {
+		Cellar string `json:"cellar"`
+		URL    string `json:"url"`
+		Sha256 string `json:"sha256"`
+	}{l.BottleTag: {Cellar: l.Cellar, URL: l.URL, Sha256: l.Sha256}}
+	return f
+}
+
+// LockfileError lists the ways a lockfile is inconsistent, either with
+// itself, with the bottle manifests it was written from or with the kegs
+// that are already installed.
+type LockfileError struct {
+	Problems []string
+}
+
+func (e *LockfileError) Error() string {
+	return fmt.Sprintf("inconsistent lockfile: %s", strings.Join(e.Problems, "; "))
+}
+
+// check returns an error listing every problem with the lockfile.
+func (l *Lockfile) check() error {
+	var problems []string
+	if l.Version != lockfileVersion {
+		problems = append(problems, fmt.Sprintf("unsupported lockfile version %d", l.Version))
+	}
+	names := map[string]bool{}
+	for _, f := range l.Formulas {
+		if names[f.Name] {
+			problems = append(problems, fmt.Sprintf("%s is locked more than once", f.Name))
+		}
+		names[f.Name] = true
+	}
+	for _, f := range l.Formulas {
+		if _, ok := f.stable(); !ok {
+			problems = append(problems, fmt.Sprintf("%s version %q doesn't match revision %d and rebuild %d",
+				f.Name, f.Version, f.Revision, f.Rebuild))
+		}
+		if f.BottleTag == "" || f.URL == "" {
+			problems = append(problems, fmt.Sprintf("%s has no bottle", f.Name))
+		}
+		if !validDigest(f.Sha256) {
+			problems = append(problems, fmt.Sprintf("%s has an invalid sha256 %q", f.Name, f.Sha256))
+		}
+		if i := strings.LastIndex(f.URL, "/blobs/sha256:"); i > 0 && f.URL[i+len("/blobs/sha256:"):] != f.Sha256 {
+			problems = append(problems, fmt.Sprintf("%s url %s doesn't match sha256 %s", f.Name, f.URL, f.Sha256))
+		}
+		for _, dep := range f.Dependencies {
+			if !names[dep] {
+				problems = append(problems, fmt.Sprintf("%s depends on %s, which isn't locked", f.Name, dep))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return &LockfileError{Problems: problems}
+	}
+	return nil
+}
+
+// ReadLockfile reads and checks the lockfile at path.
+func ReadLockfile(path string) (*Lockfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lockfile: %w", err)
+	}
+	defer f.Close()
+	var l Lockfile
+	if err := json.NewDecoder(f).Decode(&l); err != nil {
+		return nil, fmt.Errorf("error decoding lockfile %q: %w", path, err)
+	}
+	if err := l.check(); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// WriteFile writes the lockfile to path.
+func (l *Lockfile) WriteFile(path string) error {
+	v, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding lockfile: %w", err)
+	}
+	return atomicfile.WriteFile(path, bytes.NewReader(append(v, '\n')), nil)
+}
+
+// OptionWithLockfile installs exactly the bottles in l. Names must be locked,
+// either directly or through an alias or old name, and only the locked
+// dependencies are installed. Installs fail before anything is installed if
+// the lockfile is inconsistent, a bottle manifest disagrees with it or a
+// locked formula is installed from another bottle rebuild.
+func OptionWithLockfile(l *Lockfile) func(*Brewery) {
+	return func(b *Brewery) { b.lockfile = l }
+}
+
+// Lock resolves names and all of their dependencies and pins each of them to
+// the bottle for the current os. The formulas are sorted by name, so locking
+// the same formulas twice produces the same lockfile.
+func (b *Brewery) Lock(ctx context.Context, names ...string) (*Lockfile, error) {
+	ctx, span := networkTracer.Start(ctx, "brewery.Lock")
+	defer span.End()
+
+	g, err := b.dependencyGraph(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	tag := b.bottleOSString()
+	l := &Lockfile{Version: lockfileVersion}
+	for _, f := range g.sorted() {
+		// The bottle stableBottleURL picks, before any mirror is applied.
+		files, found := f.Bottle.Stable.Files[tag]
+		if !found || files.URL == "" {
+			return nil, fmt.Errorf("no %s bottle for %s", tag, f.Name)
+		}
+		digest, err := b.expectedBottleDigest(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		deps := append([]string(nil), g.deps[f.Name]...)
+		sort.Strings(deps)
+		l.Formulas = append(l.Formulas, LockedFormula{
+			Name:         f.Name,
+			Version:      f.annotatedVersion(),
+			Revision:     f.Revision,
+			Rebuild:      f.Bottle.Stable.Rebuild,
+			BottleTag:    tag,
+			Cellar:       files.Cellar,
+			URL:          files.URL,
+			Sha256:       digest,
+			Dependencies: deps,
+		})
+	}
+	sort.Slice(l.Formulas, func(i, j int) bool { return l.Formulas[i].Name < l.Formulas[j].Name })
+	return l, nil
+}
+
+// lockedKegProblem describes how the installed keg of the locked formula f,
+// if there is one, may not have been poured from the locked bottle. Installs
+// keep existing kegs, so a keg of another rebuild would be kept.
+func (b *Brewery) lockedKegProblem(f Formula) string {
+	if !b.poured(f) {
+		return ""
+	}
+	keg := b.cellar(f.Name, f.pkgVersion())
+	r, err := ReadReceipt(keg)
+	switch {
+	case err != nil:
+		return fmt.Sprintf("%s %s is installed but can't be checked: %v", f.Name, f.pkgVersion(), err)
+	case r.BottleRebuild == nil:
+		return fmt.Sprintf("%s %s is installed from an unknown bottle rebuild, not the locked %d",
+			f.Name, f.pkgVersion(), f.Bottle.Stable.Rebuild)
+	case *r.BottleRebuild != f.Bottle.Stable.Rebuild:
+		return fmt.Sprintf("%s %s is installed from bottle rebuild %d, not the locked %d",
+			f.Name, f.pkgVersion(), *r.BottleRebuild, f.Bottle.Stable.Rebuild)
+	}
+	return ""
+}
+
+// lockedGraph is resolveGraph for installs with a lockfile. The graph is the
+// closure of names within the lockfile and every formula in it is pinned to
+// its locked bottle. The rest of each formula, like whether it's keg-only,
+// comes from formula.json when the formula is still listed there.
+func (b *Brewery) lockedGraph(ctx context.Context, names ...string) (*depGraph, error) {
+	ctx, span := networkTracer.Start(ctx, "brewery.lockedGraph")
+	defer span.End()
+
+	if err := b.lockfile.check(); err != nil {
+		return nil, err
+	}
+	locked := map[string]LockedFormula{}
+	for _, l := range b.lockfile.Formulas {
+		locked[l.Name] = l
+	}
+	g := &depGraph{
+		formulas: map[string]Formula{},
+		deps:     map[string][]string{},
+		failed:   map[string]error{},
+	}
+	var problems []string
+	for _, name := range names {
+		if _, found := locked[name]; !found {
+			// Fall back to formula.json for aliases and old names.
+			if resolved, err := b.Resolve(ctx, name); err == nil {
+				g.addResolutions(resolved)
+				name = resolved[0].Name
+			}
+		}
+		if _, found := locked[name]; !found {
+			problems = append(problems, fmt.Sprintf("%s isn't locked", name))
+			continue
+		}
+		g.roots = appendUnique(g.roots, name)
+	}
+	if len(problems) > 0 {
+		return nil, &LockfileError{Problems: problems}
+	}
+
+	var closure []string
+	for queue := g.roots; len(queue) > 0; queue = queue[1:] {
+		name := queue[0]
+		if _, found := g.deps[name]; found {
+			continue
+		}
+		closure = append(closure, name)
+		g.deps[name] = locked[name].Dependencies
+		queue = append(queue, locked[name].Dependencies...)
+	}
+	formulas, resolved, _, err := b.resolveFormulas(ctx, closure...)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]Formula{}
+	for _, f := range formulas {
+		byName[f.Name] = f
+	}
+	base := map[string]Formula{}
+	for _, r := range resolved {
+		base[r.Requested] = byName[r.Name]
+	}
+
+	tag := b.bottleOSString()
+	for _, name := range closure {
+		l := locked[name]
+		if l.BottleTag != tag {
+			problems = append(problems, fmt.Sprintf("%s is locked to a %s bottle, not %s", name, l.BottleTag, tag))
+		}
+		g.formulas[name] = l.formula(base[name])
+		if problem := b.lockedKegProblem(g.formulas[name]); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &LockfileError{Problems: problems}
+	}
+
+	// The manifests are immutable, so they must still agree with the
+	// digests they were locked with, using the same check Lock did.
+	errs := make([]error, len(closure))
+	problemErrs := make([]error, len(closure))
+	sem := make(chan struct{}, b.pipeline.withDefaults().Manifests)
+	var wg sync.WaitGroup
+	for i, name := range closure {
+		i, f := i, g.formulas[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			m, err := b.DownloadManifest(ctx, f)
+			if err != nil {
+				errs[i] = fmt.Errorf("error retrieving manifest for %s: %w", f.Name, err)
+				return
+			}
+			_, problemErrs[i] = bottleDigest(f, m, tag)
+		}()
+	}
+	wg.Wait()
+	for i, name := range closure {
+		switch {
+		case errs[i] != nil:
+			g.failed[name] = errs[i]
+		case problemErrs[i] != nil:
+			problems = append(problems, problemErrs[i].Error())
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &LockfileError{Problems: problems}
+	}
+	if g.order, err = g.sort(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
@@ -0,0 +1,184 @@
+package brewery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	lib := testBottle{name: "lib", version: "1.0", revision: 1, rebuild: 2}
+	app := testBottle{name: "app", version: "2.0", deps: []string{"lib"}}
+	reg := newTestRegistry(t, lib, app, testBottle{name: "other", version: "3.0"})
+	online := reg.brewery(t)
+
+	lock, err := online.Lock(ctx, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, lock.Formulas, 2)
+	assert.Equal(t, "app", lock.Formulas[0].Name)
+	assert.Equal(t, []string{"lib"}, lock.Formulas[0].Dependencies)
+	libLock := lock.Formulas[1]
+	assert.Equal(t, "1.0_1-2", libLock.Version)
+	assert.Equal(t, "x86_64_linux", libLock.BottleTag)
+	assert.True(t, strings.HasSuffix(libLock.URL, "sha256:"+libLock.Sha256))
+
+	loc := filepath.Join(t.TempDir(), LockfileName)
+	if err := lock.WriteFile(loc); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadLockfile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, lock, read)
+
+	inconsistent := func(t *testing.T, err error) {
+		t.Helper()
+		var lockErr *LockfileError
+		if !errors.As(err, &lockErr) {
+			t.Fatalf("expected an inconsistent lockfile, got %v", err)
+		}
+	}
+	locked := func(t *testing.T, edit func(l *Lockfile)) *Brewery {
+		l := &Lockfile{Version: lock.Version}
+		for _, f := range lock.Formulas {
+			f.Dependencies = append([]string(nil), f.Dependencies...)
+			l.Formulas = append(l.Formulas, f)
+		}
+		edit(l)
+		b := reg.brewery(t)
+		OptionWithLockfile(l)(b)
+		return b
+	}
+
+	// Everything after this installs with formula.json moved on.
+	reg.set(
+		testBottle{name: "lib", version: "1.1"},
+		testBottle{name: "app", version: "2.0", deps: []string{"lib"}},
+	)
+
+	t.Run("install", func(t *testing.T) {
+		b := locked(t, func(*Lockfile) {})
+		if err := b.Install(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(b.cellar("lib", "1.0_1")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(b.cellar("lib", "1.1")); !os.IsNotExist(err) {
+			t.Fatalf("expected lib 1.1 not to be installed: %v", err)
+		}
+	})
+	t.Run("other rebuild installed", func(t *testing.T) {
+		b := locked(t, func(*Lockfile) {})
+		for i := 0; i < 2; i++ {
+			if err := b.Install(ctx, "app"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		receipt := filepath.Join(b.cellar("lib", "1.0_1"), receiptFilename)
+		v, err := os.ReadFile(receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(v, &fields); err != nil {
+			t.Fatal(err)
+		}
+		fields["bottle_rebuild"] = 1
+		if v, err = json.Marshal(fields); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(receipt, v, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inconsistent(t, b.Install(ctx, "app"))
+
+		delete(fields, "bottle_rebuild")
+		if v, err = json.Marshal(fields); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(receipt, v, 0644); err != nil {
+			t.Fatal(err)
+		}
+		inconsistent(t, b.Install(ctx, "app"))
+	})
+	t.Run("not locked", func(t *testing.T) {
+		b := locked(t, func(*Lockfile) {})
+		inconsistent(t, b.Install(ctx, "other"))
+	})
+	t.Run("missing dependency", func(t *testing.T) {
+		b := locked(t, func(l *Lockfile) { l.Formulas = l.Formulas[:1] })
+		inconsistent(t, b.Install(ctx, "app"))
+	})
+	t.Run("url and sha256 disagree", func(t *testing.T) {
+		b := locked(t, func(l *Lockfile) { l.Formulas[1].Sha256 = l.Formulas[0].Sha256 })
+		inconsistent(t, b.Install(ctx, "app"))
+	})
+	t.Run("manifest disagrees", func(t *testing.T) {
+		b := locked(t, func(l *Lockfile) {
+			l.Formulas[1].Sha256 = l.Formulas[0].Sha256
+			l.Formulas[1].URL = l.Formulas[0].URL
+		})
+		inconsistent(t, b.Install(ctx, "app"))
+		if _, err := os.Stat(b.cellar()); !os.IsNotExist(err) {
+			t.Fatalf("expected nothing to be installed: %v", err)
+		}
+	})
+	t.Run("version", func(t *testing.T) {
+		b := locked(t, func(l *Lockfile) { l.Formulas[1].Version = "1.0" })
+		inconsistent(t, b.Install(ctx, "app"))
+	})
+	t.Run("other os", func(t *testing.T) {
+		b := locked(t, func(l *Lockfile) { l.Formulas[1].BottleTag = "arm64_sonoma" })
+		inconsistent(t, b.Install(ctx, "app"))
+	})
+	t.Run("stale ref", func(t *testing.T) {
+		b := locked(t, func(*Lockfile) {})
+		stale := lib
+		stale.files = map[string]string{"STALE": "stale"}
+		s := b.store()
+		digest, err := s.putBytes(testBottleArchive(t, stale), "stale")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := bottleRef(lib.formula(), "x86_64_linux")
+		if err := s.tag(ref, digest); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Install(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(b.cellar("lib", "1.0_1"), "STALE")); !os.IsNotExist(err) {
+			t.Fatalf("expected the locked bottle to be poured: %v", err)
+		}
+		resolved, _ := s.resolve(ref)
+		assert.Equal(t, libLock.Sha256, resolved)
+	})
+	t.Run("manifest without digest", func(t *testing.T) {
+		annotation := []byte(fmt.Sprintf(`"sh.brew.bottle.digest":%q,`, libLock.Sha256))
+		reg.lock.Lock()
+		for p, v := range reg.blobs {
+			if bytes.Contains(v, annotation) {
+				reg.blobs[p] = bytes.Replace(v, annotation, nil, 1)
+				t.Cleanup(func() { reg.lock.Lock(); reg.blobs[p] = v; reg.lock.Unlock() })
+			}
+		}
+		reg.lock.Unlock()
+		b := locked(t, func(*Lockfile) {})
+		if err := b.Install(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
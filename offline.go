@@ -0,0 +1,87 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// OptionOffline makes no network requests at all. Formulas, manifests and
+// bottles are only read from the cache, and installs fail before anything is
+// installed if any of them are missing. Fill the cache with Prefetch.
+func OptionOffline() func(*Brewery) {
+	return func(b *Brewery) { b.offline = true }
+}
+
+// OfflineError is returned instead of making a request in offline mode.
+type OfflineError struct {
+	URL string
+}
+
+func (e *OfflineError) Error() string {
+	return fmt.Sprintf("not requesting %s in offline mode", e.URL)
+}
+
+// MissingArtifactsError lists what an offline install needed that isn't in
+// the cache. Artifacts are named like "api/formula.json",
+// "manifests/ruby/3.2.2" or "bottles/ruby/3.2.2.x86_64_linux".
+type MissingArtifactsError struct {
+	Artifacts []string
+}
+
+func (e *MissingArtifactsError) Error() string {
+	return fmt.Sprintf("missing from the cache in offline mode: %s", strings.Join(e.Artifacts, ", "))
+}
+
+// missingArtifacts checks that the manifest and bottle of every formula in
+// the graph that isn't installed yet is in the cache. The dependencies of a
+// formula whose manifest is missing are unknown, so they can't be checked
+// until it has been fetched.
+func (b *Brewery) missingArtifacts(g *depGraph) error {
+	var missing []string
+	for _, name := range g.order {
+		f := g.formulas[name]
+		var offline *OfflineError
+		switch {
+		case errors.As(g.failed[name], &offline):
+			missing = append(missing, manifestRef(f))
+		case g.failed[name] != nil, b.poured(f):
+		default:
+			if _, found := b.cachedBottle(f); !found {
+				missing = append(missing, bottleRef(f, b.bottleOSString()))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingArtifactsError{Artifacts: missing}
+	}
+	return nil
+}
+
+// Prefetch downloads the manifests and bottles for names and all of their
+// dependencies into the cache, installed or not, so that they can be
+// installed with OptionOffline on a machine the cache is copied to.
+func (b *Brewery) Prefetch(ctx context.Context, names ...string) error {
+	ctx, span := networkTracer.Start(ctx, "brewery.Prefetch")
+	defer span.End()
+
+	g, err := b.dependencyGraph(ctx, names...)
+	if err != nil {
+		return err
+	}
+	return b.prefetch(ctx, g)
+}
+
+// prefetch downloads the bottle of every formula in the graph.
+func (b *Brewery) prefetch(ctx context.Context, g *depGraph) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(b.pipeline.withDefaults().Downloads)
+	for _, f := range g.sorted() {
+		f := f
+		eg.Go(func() error { return b.downloadFormula(ctx, f) })
+	}
+	return eg.Wait()
+}
@@ -0,0 +1,89 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffline(t *testing.T) {
+	ctx := context.Background()
+	lib := testBottle{name: "lib", version: "1.0"}
+	app := testBottle{name: "app", version: "2.0", deps: []string{"lib"}}
+	reg := newTestRegistry(t, lib, app)
+	online := reg.brewery(t)
+	offline := func(t *testing.T, cache string) *Brewery {
+		b := &Brewery{prefix: t.TempDir(), cacheLocation: cache, httpClient: reg.server.Client()}
+		OptionOffline()(b)
+		return b
+	}
+	missing := func(t *testing.T, err error) []string {
+		t.Helper()
+		var missingErr *MissingArtifactsError
+		if !errors.As(err, &missingErr) {
+			t.Fatalf("expected missing artifacts, got %v", err)
+		}
+		return missingErr.Artifacts
+	}
+	requests := func() (n int) {
+		reg.lock.Lock()
+		defer reg.lock.Unlock()
+		for _, count := range reg.requests {
+			n += count
+		}
+		return n
+	}
+
+	t.Run("empty cache", func(t *testing.T) {
+		err := offline(t, t.TempDir()).Install(ctx, "app")
+		assert.Equal(t, []string{"api/formula.json"}, missing(t, err))
+	})
+	t.Run("missing manifest", func(t *testing.T) {
+		before := requests()
+		err := offline(t, online.cacheLocation).Install(ctx, "app")
+		assert.Equal(t, []string{"manifests/app/2.0"}, missing(t, err))
+		assert.Equal(t, before, requests())
+	})
+	t.Run("prefetched", func(t *testing.T) {
+		if err := online.Prefetch(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		before := requests()
+		b := offline(t, online.cacheLocation)
+		if err := b.Install(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"lib", "app"} {
+			if _, err := os.Stat(b.cellar(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, before, requests())
+	})
+	t.Run("missing bottles", func(t *testing.T) {
+		if err := os.RemoveAll(online.store().blobDir()); err != nil {
+			t.Fatal(err)
+		}
+		if err := online.Prefetch(ctx, "lib"); err != nil {
+			t.Fatal(err)
+		}
+		_, err := offline(t, online.cacheLocation).InstallMany(ctx, []string{"app"}, InstallOptions{})
+		// Without its manifest the dependencies of app are unknown.
+		assert.Equal(t, []string{"manifests/app/2.0"}, missing(t, err))
+
+		if err := online.Prefetch(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []Formula{lib.formula(), app.formula()} {
+			loc, _ := online.cachedBottle(f)
+			if err := os.Remove(loc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = offline(t, online.cacheLocation).Install(ctx, "app")
+		assert.Equal(t, []string{"bottles/lib/1.0.x86_64_linux", "bottles/app/2.0.x86_64_linux"}, missing(t, err))
+	})
+}
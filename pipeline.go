@@ -0,0 +1,256 @@
+package brewery
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// PipelineConfig sets the number of workers in each stage of an install.
+// Fields that are zero use the default for that stage.
+type PipelineConfig struct {
+	// Manifests is the number of bottle manifests fetched at once while
+	// resolving dependencies. Defaults to 6.
+	Manifests int
+	// Downloads is the number of bottles downloaded at once. Defaults to 6.
+	Downloads int
+	// Extract is the number of bottles decompressed and extracted at once.
+	// Defaults to the number of CPUs.
+	Extract int
+	// Relocate is the number of kegs relocated at once. Defaults to the
+	// number of CPUs.
+	Relocate int
+	// Link is the number of kegs poured and linked at once. Kegs are always
+	// linked after their dependencies. Defaults to 1, as formulas that link
+	// the same files race with each other.
+	Link int
+}
+
+// OptionWithPipeline configures the worker pools used by the install
+// pipeline.
+func OptionWithPipeline(c PipelineConfig) func(*Brewery) {
+	return func(b *Brewery) { b.pipeline = c }
+}
+
+func (c PipelineConfig) withDefaults() PipelineConfig {
+	for _, v := range []struct {
+		field *int
+		def   int
+	}{
+		{&c.Manifests, 6},
+		{&c.Downloads, 6},
+		{&c.Extract, runtime.NumCPU()},
+		{&c.Relocate, runtime.NumCPU()},
+		{&c.Link, 1},
+	} {
+		if *v.field <= 0 {
+			*v.field = v.def
+		}
+	}
+	return c
+}
+
+// pipelineStage is a step of the install that runs on a pool of workers.
+type pipelineStage struct {
+	name    string
+	workers int
+	fn      func(ctx context.Context, f Formula) error
+}
+
+// pipelineItem is a formula moving through the pipeline. Once err is set the
+// remaining stages are skipped.
+type pipelineItem struct {
+	formula Formula
+	err     error
+}
+
+// runPipeline passes every formula in the graph through stages, each stage
+// running on its own pool of workers with a bounded queue in front of it so
+// that a slow stage holds back the ones before it. Formulas that make it
+// through are handed to link once link has completed for all of their
+// dependencies.
+//
+// A failure skips everything that depends on the failed formula but the rest
+// of the graph carries on, unless failFast is set in which case everything
+// that hasn't started yet is cancelled. The error of every formula that
+// failed or was skipped is returned.
+func (g *depGraph) runPipeline(
+	ctx context.Context, stages []pipelineStage, link pipelineStage, failFast bool,
+) (errs map[string]error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fail := func(error) {
+		if failFast {
+			cancel()
+		}
+	}
+	in := make(chan pipelineItem, len(g.order))
+	for _, name := range g.order {
+		item := pipelineItem{formula: g.formulas[name], err: g.failed[name]}
+		if item.err != nil {
+			fail(item.err)
+		}
+		in <- item
+	}
+	close(in)
+
+	for _, stage := range stages {
+		in = runStage(ctx, stage, in, fail)
+	}
+	return g.linkStage(ctx, link, in, fail)
+}
+
+func runStage(
+	ctx context.Context, stage pipelineStage, in <-chan pipelineItem, fail func(error),
+) chan pipelineItem {
+	_, span := diskTracer.Start(ctx, "pipeline "+stage.name)
+	out := make(chan pipelineItem, stage.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < stage.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range in {
+				if item.err == nil {
+					item.err = ctx.Err()
+				}
+				if item.err == nil {
+					if item.err = stage.fn(ctx, item.formula); item.err != nil {
+						fail(item.err)
+					}
+				}
+				out <- item
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		span.End()
+		close(out)
+	}()
+	return out
+}
+
+// linkStage holds back each formula until all of its dependencies have been
+// linked, or one of them has failed, and then runs link on it.
+func (g *depGraph) linkStage(
+	ctx context.Context, link pipelineStage, in <-chan pipelineItem, fail func(error),
+) (errs map[string]error) {
+	errs = map[string]error{}
+	finished := map[string]bool{}
+	var pending []Formula
+	ready := make(chan Formula)
+	linked := make(chan pipelineItem)
+	var wg sync.WaitGroup
+	for i := 0; i < link.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ready {
+				err := ctx.Err()
+				if err == nil {
+					if err = link.fn(ctx, f); err != nil {
+						fail(err)
+					}
+				}
+				linked <- pipelineItem{formula: f, err: err}
+			}
+		}()
+	}
+
+	finish := func(item pipelineItem) {
+		finished[item.formula.Name] = true
+		if item.err != nil {
+			errs[item.formula.Name] = item.err
+		}
+	}
+	// dispatch moves every pending formula whose dependencies are finished
+	// onto queue, failing the ones with a failed dependency.
+	var queue []Formula
+	dispatch := func() {
+		for changed := true; changed; {
+			changed = false
+			remaining := pending[:0]
+			for _, f := range pending {
+				waiting := false
+				var failedDep string
+				for _, dep := range g.deps[f.Name] {
+					switch {
+					case !finished[dep]:
+						waiting = true
+					case errs[dep] != nil && failedDep == "":
+						failedDep = dep
+					}
+				}
+				switch {
+				case failedDep != "":
+					finish(pipelineItem{formula: f, err: &DependencyFailedError{Name: f.Name, Dependency: failedDep}})
+					changed = true
+				case waiting:
+					remaining = append(remaining, f)
+				default:
+					queue = append(queue, f)
+				}
+			}
+			pending = remaining
+		}
+	}
+
+	running := 0
+	for in != nil || running > 0 || len(queue) > 0 {
+		var send chan Formula
+		var next Formula
+		if len(queue) > 0 {
+			send, next = ready, queue[0]
+		}
+		select {
+		case item, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if item.err != nil {
+				finish(item)
+			} else {
+				pending = append(pending, item.formula)
+			}
+			dispatch()
+		case send <- next:
+			queue = queue[1:]
+			running++
+		case item := <-linked:
+			running--
+			finish(item)
+			dispatch()
+		}
+	}
+	close(ready)
+	wg.Wait()
+	// Anything left is waiting on a dependency that never arrived, which
+	// only happens if the graph is inconsistent.
+	for _, f := range pending {
+		errs[f.Name] = &DependencyFailedError{Name: f.Name, Dependency: g.deps[f.Name][0]}
+	}
+	return errs
+}
+
+// install runs the install pipeline over the graph.
+func (b *Brewery) install(ctx context.Context, g *depGraph, failFast bool) map[string]error {
+	c := b.pipeline.withDefaults()
+	stages := []pipelineStage{
+		{name: "download", workers: c.Downloads, fn: b.downloadFormula},
+		{name: "extract", workers: c.Extract, fn: b.extractFormula},
+		{name: "relocate", workers: c.Relocate, fn: b.relocateUnpacked},
+	}
+	if b.streamExtract {
+		// Extraction happens as part of the download.
+		stages = append([]pipelineStage{
+			{name: "stream", workers: c.Downloads, fn: b.streamFormula},
+		}, stages[2:]...)
+	}
+	link := pipelineStage{name: "link", workers: c.Link, fn: func(ctx context.Context, f Formula) error {
+		return b.pourFormula(ctx, f, g.isRoot(f.Name))
+	}}
+	return g.runPipeline(ctx, stages, link, failFast)
+}
@@ -0,0 +1,450 @@
+// Package proxy is a caching proxy for the formula API and the bottle
+// registry. Pointing HOMEBREW_API_DOMAIN and HOMEBREW_ARTIFACT_DOMAIN at it
+// lets a fleet of machines running brew or brewery share downloads.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxmcd/brewery/internal/atomicfile"
+)
+
+const (
+	defaultAPIUpstream      = "https://formulae.brew.sh/api"
+	defaultRegistryUpstream = "https://ghcr.io"
+	// defaultBlobUpstream is where ghcr.io redirects blob requests to.
+	defaultBlobUpstream = "https://pkg-containers.githubusercontent.com"
+
+	// maxManifestSize bounds how much of a manifest is read into memory.
+	maxManifestSize = 4 << 20
+	// accessTTL is how long upstream letting a client pull from a
+	// repository is trusted for before it is checked again.
+	accessTTL = time.Minute
+)
+
+var (
+	// registryPath matches manifest and blob requests. Repository and
+	// reference names are restricted so they can't escape the cache.
+	registryPath = regexp.MustCompile(
+		`^/v2/((?:[a-z0-9][a-z0-9._+-]*/)*[a-z0-9][a-z0-9._+-]*)/(manifests|blobs)/([A-Za-z0-9_][A-Za-z0-9._-]*|sha256:[0-9a-f]{64})$`)
+	sha256Digest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+	realmParam   = regexp.MustCompile(`realm="([^"]*)"`)
+)
+
+// Proxy serves the formula API from /api and the registry from /v2.
+// Manifests and blobs are cached on disk by digest, everything else is
+// forwarded upstream. Repositories may be private, so a client is only
+// served from the cache once upstream has accepted its credentials for the
+// repository.
+type Proxy struct {
+	dir      string
+	client   *http.Client
+	api      string
+	registry string
+	blobs    string
+
+	apiURL, registryURL, blobsURL *url.URL
+	forward                       *httputil.ReverseProxy
+
+	accessLock sync.Mutex
+	// access holds when upstream last let an Authorization header pull
+	// from a repository.
+	access map[string]time.Time
+}
+
+type Option func(*Proxy)
+
+// OptionWithHTTPClient sets the client used to make upstream requests.
+func OptionWithHTTPClient(c *http.Client) Option {
+	return func(p *Proxy) { p.client = c }
+}
+
+// OptionWithAPIUpstream sets the formula API that is proxied, it defaults to
+// https://formulae.brew.sh/api.
+func OptionWithAPIUpstream(u string) Option {
+	return func(p *Proxy) { p.api = u }
+}
+
+// OptionWithRegistryUpstream sets the registry that is proxied, it defaults
+// to https://ghcr.io.
+func OptionWithRegistryUpstream(u string) Option {
+	return func(p *Proxy) { p.registry = u }
+}
+
+// New returns a Proxy that caches in dir.
+func New(dir string, opts ...Option) (*Proxy, error) {
+	p := &Proxy{
+		dir:      dir,
+		api:      defaultAPIUpstream,
+		registry: defaultRegistryUpstream,
+		blobs:    defaultBlobUpstream,
+		access:   map[string]time.Time{},
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.client == nil {
+		p.client = &http.Client{}
+	}
+	for _, u := range []struct {
+		raw    string
+		parsed **url.URL
+	}{
+		{p.api, &p.apiURL},
+		{p.registry, &p.registryURL},
+		{p.blobs, &p.blobsURL},
+	} {
+		parsed, err := url.Parse(strings.TrimSuffix(u.raw, "/"))
+		if err != nil || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid upstream url %q", u.raw)
+		}
+		*u.parsed = parsed
+	}
+	for _, d := range []string{filepath.Join("blobs", "sha256"), "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("error creating cache directory: %w", err)
+		}
+	}
+	p.forward = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = p.upstreamURL(pr.In.URL)
+			pr.Out.Host = pr.Out.URL.Host
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			p.rewriteHeaders(resp.Header, resp.Request.Context().Value(baseKey{}).(*url.URL))
+			return nil
+		},
+		Transport: p.client.Transport,
+	}
+	return p, nil
+}
+
+type baseKey struct{}
+
+// upstreamURL maps a request to the proxy onto the upstream it is for.
+func (p *Proxy) upstreamURL(in *url.URL) *url.URL {
+	var u url.URL
+	switch {
+	case strings.HasPrefix(in.Path, "/v2/"), in.Path == "/token":
+		u = *p.registryURL
+		u.Path += in.Path
+	case strings.HasPrefix(in.Path, "/ghcr1/"):
+		u = *p.blobsURL
+		u.Path += in.Path
+	default:
+		// The API is served with or without the /api prefix, depending on
+		// whether HOMEBREW_API_DOMAIN includes it.
+		u = *p.apiURL
+		u.Path += strings.TrimPrefix(in.Path, "/api")
+	}
+	u.RawQuery = in.RawQuery
+	return &u
+}
+
+// proxyURL is the inverse of upstreamURL, it returns false for urls that
+// aren't upstream of the proxy.
+func (p *Proxy) proxyURL(u, base *url.URL) (*url.URL, bool) {
+	out := *base
+	out.RawQuery = u.RawQuery
+	switch {
+	case u.Host == p.registryURL.Host && strings.HasPrefix(u.Path, p.registryURL.Path+"/"):
+		out.Path += strings.TrimPrefix(u.Path, p.registryURL.Path)
+	case u.Host == p.blobsURL.Host && strings.HasPrefix(u.Path, p.blobsURL.Path+"/"):
+		out.Path += strings.TrimPrefix(u.Path, p.blobsURL.Path)
+	case u.Host == p.apiURL.Host && strings.HasPrefix(u.Path, p.apiURL.Path+"/"):
+		out.Path += "/api" + strings.TrimPrefix(u.Path, p.apiURL.Path)
+	default:
+		return nil, false
+	}
+	return &out, true
+}
+
+// rewriteHeaders points redirects and authentication realms at the proxy so
+// that clients keep talking to it.
+func (p *Proxy) rewriteHeaders(h http.Header, base *url.URL) {
+	if loc := h.Get("Location"); loc != "" {
+		if u, err := url.Parse(loc); err == nil {
+			if u, ok := p.proxyURL(u, base); ok {
+				h.Set("Location", u.String())
+			}
+		}
+	}
+	if challenge := h.Get("Www-Authenticate"); challenge != "" {
+		h.Set("Www-Authenticate", realmParam.ReplaceAllStringFunc(challenge, func(m string) string {
+			u, err := url.Parse(realmParam.FindStringSubmatch(m)[1])
+			if err != nil {
+				return m
+			}
+			if u, ok := p.proxyURL(u, base); ok {
+				return `realm="` + u.String() + `"`
+			}
+			return m
+		}))
+	}
+}
+
+func baseURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := baseURL(r)
+	r = r.WithContext(context.WithValue(r.Context(), baseKey{}, base))
+	m := registryPath.FindStringSubmatch(r.URL.Path)
+	switch {
+	case m == nil, r.Method != http.MethodGet && r.Method != http.MethodHead:
+	case m[2] == "blobs" && sha256Digest.MatchString(m[3]):
+		p.serveBlob(w, r, m[1], m[3])
+		return
+	case m[2] == "manifests":
+		p.serveManifest(w, r, m[1], m[3])
+		return
+	}
+	p.forward.ServeHTTP(w, r)
+}
+
+func (p *Proxy) blobPath(digest string) string {
+	return filepath.Join(p.dir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// serveBlob serves a blob from the cache, or streams it from upstream while
+// writing it to the cache. Two clients missing the same blob at once both
+// download it, whichever finishes last replaces the other's copy.
+func (p *Proxy) serveBlob(w http.ResponseWriter, r *http.Request, repo, digest string) {
+	if exists(p.blobPath(digest)) {
+		if !p.authorize(w, r, repo) {
+			return
+		}
+		if p.serveCached(w, r, p.blobPath(digest), "application/octet-stream", digest) {
+			return
+		}
+	}
+	if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+		// Partial requests aren't worth caching.
+		p.forward.ServeHTTP(w, r)
+		return
+	}
+	resp, err := p.fetch(r, http.MethodGet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.copyResponse(w, r, resp)
+		return
+	}
+	p.grant(r, repo)
+
+	copyHeader(w.Header(), resp.Header, "Content-Type", "Content-Length", "Docker-Content-Digest")
+	w.WriteHeader(http.StatusOK)
+	h := sha256.New()
+	if err := atomicfile.WriteFile(p.blobPath(digest), io.TeeReader(resp.Body, io.MultiWriter(h, w)), func() error {
+		if sum := "sha256:" + hex.EncodeToString(h.Sum(nil)); sum != digest {
+			return fmt.Errorf("digest mismatch for blob %s: got %s", digest, sum)
+		}
+		return nil
+	}); err != nil {
+		log.Printf("error caching %s: %v", r.URL.Path, err)
+	}
+}
+
+// manifestRef is the digest and media type that a manifest reference
+// resolves to.
+type manifestRef struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"media_type"`
+}
+
+// refPath is where the digest of repo:ref is stored. Bottles are tagged with
+// their version and rebuild, so tags are assumed to never change.
+func (p *Proxy) refPath(repo, ref string) string {
+	return filepath.Join(p.dir, "manifests", filepath.FromSlash(repo), ref+".json")
+}
+
+// serveManifest serves a manifest from the cache, or fetches it from
+// upstream and caches it.
+func (p *Proxy) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	var cached manifestRef
+	if f, err := os.ReadFile(p.refPath(repo, ref)); err == nil && json.Unmarshal(f, &cached) == nil &&
+		exists(p.blobPath(cached.Digest)) {
+		if !p.authorize(w, r, repo) {
+			return
+		}
+		if p.serveCached(w, r, p.blobPath(cached.Digest), cached.MediaType, cached.Digest) {
+			return
+		}
+	}
+	if r.Method == http.MethodHead {
+		p.forward.ServeHTTP(w, r)
+		return
+	}
+	resp, err := p.fetch(r, http.MethodGet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.copyResponse(w, r, resp)
+		return
+	}
+	p.grant(r, repo)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err == nil && len(body) > maxManifestSize {
+		err = fmt.Errorf("manifest is larger than %d bytes", maxManifestSize)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading manifest: %v", err), http.StatusBadGateway)
+		return
+	}
+	sum := sha256.Sum256(body)
+	m := manifestRef{
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		MediaType: resp.Header.Get("Content-Type"),
+	}
+	for _, expected := range []string{resp.Header.Get("Docker-Content-Digest"), ref} {
+		if sha256Digest.MatchString(expected) && expected != m.Digest {
+			http.Error(w, fmt.Sprintf("digest mismatch for manifest %s: got %s", expected, m.Digest), http.StatusBadGateway)
+			return
+		}
+	}
+	if err := p.cacheManifest(repo, ref, m, body); err != nil {
+		log.Printf("error caching %s: %v", r.URL.Path, err)
+	}
+	w.Header().Set("Content-Type", m.MediaType)
+	w.Header().Set("Docker-Content-Digest", m.Digest)
+	_, _ = w.Write(body)
+}
+
+func (p *Proxy) cacheManifest(repo, ref string, m manifestRef, body []byte) error {
+	if err := atomicfile.WriteFile(p.blobPath(m.Digest), bytes.NewReader(body), nil); err != nil {
+		return err
+	}
+	v, _ := json.Marshal(m)
+	loc := p.refPath(repo, ref)
+	if err := os.MkdirAll(filepath.Dir(loc), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %q: %w", loc, err)
+	}
+	return atomicfile.WriteFile(loc, bytes.NewReader(v), nil)
+}
+
+// serveCached serves the file at loc if it exists, reporting whether it did.
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, loc, contentType, digest string) bool {
+	f, err := os.Open(loc)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("ETag", `"`+digest+`"`)
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+	return true
+}
+
+// authorize checks that the client may pull from repo before it is served
+// from the cache. The request is made upstream as a HEAD with the client's
+// credentials, and if upstream refuses it, its response is passed on so the
+// client can authenticate.
+func (p *Proxy) authorize(w http.ResponseWriter, r *http.Request, repo string) bool {
+	key := accessKey(r, repo)
+	p.accessLock.Lock()
+	granted := time.Since(p.access[key]) < accessTTL
+	p.accessLock.Unlock()
+	if granted {
+		return true
+	}
+	resp, err := p.fetch(r, http.MethodHead)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p.copyResponse(w, r, resp)
+		return false
+	}
+	p.grant(r, repo)
+	return true
+}
+
+// grant records that upstream let the client of r pull from repo.
+func (p *Proxy) grant(r *http.Request, repo string) {
+	p.accessLock.Lock()
+	defer p.accessLock.Unlock()
+	now := time.Now()
+	for k, t := range p.access {
+		if now.Sub(t) >= accessTTL {
+			delete(p.access, k)
+		}
+	}
+	p.access[accessKey(r, repo)] = now
+}
+
+func accessKey(r *http.Request, repo string) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return repo + " " + hex.EncodeToString(sum[:])
+}
+
+func exists(loc string) bool {
+	_, err := os.Stat(loc)
+	return err == nil
+}
+
+// fetch makes r upstream with method, following any redirects.
+func (p *Proxy) fetch(r *http.Request, method string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), method, p.upstreamURL(r.URL).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, r.Header, "Accept", "Authorization", "User-Agent")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %q: %w", req.URL, err)
+	}
+	return resp, nil
+}
+
+// copyResponse passes an upstream response that isn't being cached on to
+// the client.
+func (p *Proxy) copyResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	p.rewriteHeaders(w.Header(), baseURL(r))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func copyHeader(dst, src http.Header, keys ...string) {
+	for _, k := range keys {
+		if v := src.Get(k); v != "" {
+			dst.Set(k, v)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// upstream is a registry that requires a token and redirects blob requests
+// elsewhere, like ghcr.io.
+type upstream struct {
+	server   *httptest.Server
+	lock     sync.Mutex
+	requests map[string]int
+	blobs    map[string]string
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := &upstream{requests: map[string]int{}, blobs: map[string]string{}}
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.lock.Lock()
+		defer u.lock.Unlock()
+		u.requests[r.URL.Path]++
+		switch {
+		case r.URL.Path == "/api/formula.json":
+			_, _ = io.WriteString(w, "[]")
+		case r.URL.Path == "/api/moved.json":
+			http.Redirect(w, r, u.server.URL+"/api/formula.json", http.StatusFound)
+		case r.URL.Path == "/token":
+			_, _ = io.WriteString(w, `{"token": "tok"}`)
+		case r.Header.Get("Authorization") != "Bearer tok":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, u.server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case strings.HasPrefix(r.URL.Path, "/v2/homebrew/core/foo/manifests/"):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			_, _ = io.WriteString(w, `{"schemaVersion": 2}`)
+		case strings.HasPrefix(r.URL.Path, "/v2/homebrew/core/foo/blobs/"):
+			digest := strings.TrimPrefix(r.URL.Path, "/v2/homebrew/core/foo/blobs/")
+			http.Redirect(w, r, u.server.URL+"/storage/"+digest, http.StatusTemporaryRedirect)
+		case strings.HasPrefix(r.URL.Path, "/storage/"):
+			body, found := u.blobs[strings.TrimPrefix(r.URL.Path, "/storage/")]
+			if !found {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = io.WriteString(w, body)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *upstream) count(path string) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.requests[path]
+}
+
+func digestOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newTestProxy(t *testing.T, u *upstream) *httptest.Server {
+	p, err := New(t.TempDir(),
+		OptionWithHTTPClient(u.server.Client()),
+		OptionWithAPIUpstream(u.server.URL+"/api"),
+		OptionWithRegistryUpstream(u.server.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, u string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+var authorized = http.Header{"Authorization": {"Bearer tok"}}
+
+func TestProxyManifest(t *testing.T) {
+	u := newUpstream(t)
+	proxy := newTestProxy(t, u)
+	manifest := "/v2/homebrew/core/foo/manifests/1.0"
+
+	// Challenges send clients to the proxy for a token.
+	resp, _ := get(t, proxy.URL+manifest, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf(`Bearer realm="%s/token",service="test"`, proxy.URL), resp.Header.Get("WWW-Authenticate"))
+	_, body := get(t, proxy.URL+"/token", nil)
+	assert.Equal(t, `{"token": "tok"}`, body)
+
+	resp, body = get(t, proxy.URL+manifest, authorized)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"schemaVersion": 2}`, body)
+	assert.Equal(t, digestOf(body), resp.Header.Get("Docker-Content-Digest"))
+
+	// Cached manifests are only served to clients upstream accepts.
+	resp, _ = get(t, proxy.URL+manifest, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf(`Bearer realm="%s/token",service="test"`, proxy.URL), resp.Header.Get("WWW-Authenticate"))
+	resp, _ = get(t, proxy.URL+manifest, http.Header{"Authorization": {"Bearer stolen"}})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, body = get(t, proxy.URL+manifest, authorized)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `{"schemaVersion": 2}`, body)
+	assert.Equal(t, "application/vnd.oci.image.index.v1+json", resp.Header.Get("Content-Type"))
+	// The unauthorized request, the fetch and the two refused checks. The
+	// fetch already showed the authorized client has access.
+	assert.Equal(t, 4, u.count(manifest))
+}
+
+func TestProxyBlob(t *testing.T) {
+	u := newUpstream(t)
+	proxy := newTestProxy(t, u)
+	content := "a bottle"
+	digest := digestOf(content)
+	u.blobs[digest] = content
+	blob := "/v2/homebrew/core/foo/blobs/" + digest
+
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, proxy.URL+blob, authorized)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, body)
+	}
+	assert.Equal(t, 1, u.count(blob))
+	assert.Equal(t, 1, u.count("/storage/"+digest))
+
+	// Downloads resume from the cache.
+	resp, body := get(t, proxy.URL+blob, http.Header{"Range": {"bytes=2-"}, "Authorization": {"Bearer tok"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[2:], body)
+
+	// Cached blobs aren't served to clients upstream refuses.
+	resp, body = get(t, proxy.URL+blob, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotContains(t, body, content)
+	assert.Equal(t, 1, u.count("/storage/"+digest))
+
+	// A blob that doesn't match its digest isn't cached.
+	wrong := digestOf("another bottle")
+	u.blobs[wrong] = "not another bottle"
+	for i := 0; i < 2; i++ {
+		get(t, proxy.URL+"/v2/homebrew/core/foo/blobs/"+wrong, authorized)
+	}
+	assert.Equal(t, 2, u.count("/storage/"+wrong))
+}
+
+func TestProxyAPI(t *testing.T) {
+	u := newUpstream(t)
+	proxy := newTestProxy(t, u)
+
+	for _, path := range []string{"/api/formula.json", "/formula.json"} {
+		resp, body := get(t, proxy.URL+path, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "[]", body)
+	}
+	resp, _ := get(t, proxy.URL+"/api/moved.json", nil)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, proxy.URL+"/api/formula.json", resp.Header.Get("Location"))
+}
@@ -0,0 +1,145 @@
+package brewery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+const receiptFilename = "INSTALL_RECEIPT.json"
+
+// Receipt is the INSTALL_RECEIPT.json brew writes into every keg it installs.
+// Writing one into the kegs we pour lets brew list, upgrade and uninstall
+// them.
+type Receipt struct {
+	HomebrewVersion       string        `json:"homebrew_version"`
+	UsedOptions           []string      `json:"used_options"`
+	UnusedOptions         []string      `json:"unused_options"`
+	BuiltAsBottle         bool          `json:"built_as_bottle"`
+	PouredFromBottle      bool          `json:"poured_from_bottle"`
+	LoadedFromAPI         bool          `json:"loaded_from_api"`
+	InstalledAsDependency bool          `json:"installed_as_dependency"`
+	InstalledOnRequest    bool          `json:"installed_on_request"`
+	ChangedFiles          []string      `json:"changed_files"`
+	Time                  int64         `json:"time"`
+	SourceModifiedTime    int           `json:"source_modified_time"`
+	Compiler              string        `json:"compiler"`
+	Aliases               []string      `json:"aliases"`
+	RuntimeDependencies   []Dependency  `json:"runtime_dependencies"`
+	Source                ReceiptSource `json:"source"`
+	Arch                  string        `json:"arch"`
+	BuiltOn               BuiltOn       `json:"built_on"`
+	// BottleRebuild isn't written by brew, but lets us notice when a bottle
+	// has been rebuilt without a version change. It is nil for kegs brew
+	// installed, whose rebuild is unknown.
+	BottleRebuild *int `json:"bottle_rebuild,omitempty"`
+}
+
+type ReceiptSource struct {
+	Path       string `json:"path"`
+	Tap        string `json:"tap"`
+	TapGitHead string `json:"tap_git_head"`
+	Spec       string `json:"spec"`
+	Versions   struct {
+		Stable        string  `json:"stable"`
+		Head          *string `json:"head"`
+		VersionScheme int     `json:"version_scheme"`
+	} `json:"versions"`
+}
+
+// newReceipt builds the receipt for a formula poured from a bottle with the
+// tab tb.
+func (b *Brewery) newReceipt(formula Formula, tb BrewTab, onRequest bool) Receipt {
+	r := Receipt{
+		HomebrewVersion:       tb.HomebrewVersion,
+		UsedOptions:           []string{},
+		UnusedOptions:         []string{},
+		BuiltAsBottle:         true,
+		PouredFromBottle:      true,
+		LoadedFromAPI:         true,
+		InstalledAsDependency: !onRequest,
+		InstalledOnRequest:    onRequest,
+		ChangedFiles:          tb.ChangedFiles,
+		Time:                  time.Now().Unix(),
+		SourceModifiedTime:    tb.SourceModifiedTime,
+		Compiler:              tb.Compiler,
+		Aliases:               formula.Aliases,
+		RuntimeDependencies:   tb.RuntimeDependencies,
+		Arch:                  tb.Arch,
+		BuiltOn:               tb.BuiltOn,
+		BottleRebuild:         &formula.Bottle.Stable.Rebuild,
+	}
+	if r.Aliases == nil {
+		r.Aliases = []string{}
+	}
+	if r.Arch == "" {
+		r.Arch = runtime.GOARCH
+	}
+	r.Source.Path = b.cache("api", "formula.json")
+	r.Source.Tap = formula.Tap
+	r.Source.TapGitHead = formula.TapGitHead
+	r.Source.Spec = "stable"
+	r.Source.Versions.Stable = formula.Versions.Stable
+	if formula.Versions.Head != "" {
+		head := formula.Versions.Head
+		r.Source.Versions.Head = &head
+	}
+	r.Source.Versions.VersionScheme = formula.VersionScheme
+	return r
+}
+
+// writeReceipt writes the install receipt into the poured keg for formula.
+// Kegs that were previously installed on request stay that way when they
+// are installed again as a dependency.
+func (b *Brewery) writeReceipt(ctx context.Context, formula Formula, onRequest bool) (err error) {
+	_, span := diskTracer.Start(ctx, "writeReceipt "+formula.Name)
+	defer span.End()
+
+	m, err := b.DownloadManifest(ctx, formula)
+	if err != nil {
+		return fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
+	}
+	tb, err := m.TabForCurrentOS()
+	if err != nil {
+		return fmt.Errorf("error fetching information about the current os: %w", err)
+	}
+	keg := b.cellar(formula.Name, formula.pkgVersion())
+	if existing, err := ReadReceipt(keg); err == nil && existing.PouredFromBottle && existing.InstalledOnRequest {
+		onRequest = true
+	}
+	return writeReceiptFile(keg, b.newReceipt(formula, tb, onRequest))
+}
+
+func writeReceiptFile(keg string, r Receipt) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding install receipt: %w", err)
+	}
+	loc := filepath.Join(keg, receiptFilename)
+	// The receipt shipped inside the bottle may be read-only.
+	if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing %q: %w", loc, err)
+	}
+	if err := os.WriteFile(loc, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing %q: %w", loc, err)
+	}
+	return nil
+}
+
+// ReadReceipt reads the install receipt of the keg at the given path.
+func ReadReceipt(keg string) (r Receipt, err error) {
+	loc := filepath.Join(keg, receiptFilename)
+	f, err := os.Open(loc)
+	if err != nil {
+		return r, fmt.Errorf("error opening install receipt %q: %w", loc, err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&r); err != nil {
+		return r, fmt.Errorf("error parsing install receipt %q: %w", loc, err)
+	}
+	return r, nil
+}
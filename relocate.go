@@ -0,0 +1,97 @@
+package brewery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	prefixPlaceholder     = "@@HOMEBREW_PREFIX@@"
+	cellarPlaceholder     = "@@HOMEBREW_CELLAR@@"
+	repositoryPlaceholder = "@@HOMEBREW_REPOSITORY@@"
+	libraryPlaceholder    = "@@HOMEBREW_LIBRARY@@"
+)
+
+// placeholderReplacer swaps the placeholders brew writes into bottles for the
+// locations of this installation.
+func (b *Brewery) placeholderReplacer() *strings.Replacer {
+	return strings.NewReplacer(
+		prefixPlaceholder, b.prefix,
+		cellarPlaceholder, b.cellar(),
+		repositoryPlaceholder, b.repository,
+		libraryPlaceholder, filepath.Join(b.repository, "Library"),
+	)
+}
+
+// relocateBottle replaces the placeholders in a bottle that has been unpacked
+// into dir.
+func (b *Brewery) relocateBottle(ctx context.Context, formula Formula, dir string) (err error) {
+	_, span := diskTracer.Start(ctx, "relocateBottle "+formula.Name)
+	defer span.End()
+
+	m, err := b.DownloadManifest(ctx, formula)
+	if err != nil {
+		return fmt.Errorf("error retrieving manifest for %s: %w", formula.Name, err)
+	}
+	tb, err := m.TabForCurrentOS()
+	if err != nil {
+		return fmt.Errorf("error fetching information about the current os: %w", err)
+	}
+	keg := filepath.Join(dir, formula.Name, formula.pkgVersion())
+	cellar := formula.Bottle.Stable.Files[b.bottleOSString()].Cellar
+	if err := b.relocateKeg(keg, cellar, tb.ChangedFiles); err != nil {
+		return fmt.Errorf("error relocating %s: %w", formula.Name, err)
+	}
+	return nil
+}
+
+// relocateKeg rewrites the placeholders in the changed files of a keg and in
+// the interpreter and runpaths of its ELF binaries. Bottles with a cellar of
+// ":any_skip_relocation" contain no placeholders and are left untouched.
+func (b *Brewery) relocateKeg(keg, cellar string, changedFiles []string) error {
+	if cellar == ":any_skip_relocation" {
+		return nil
+	}
+	r := b.placeholderReplacer()
+	for _, name := range changedFiles {
+		if err := relocateTextFile(filepath.Join(keg, name), r); err != nil {
+			return err
+		}
+	}
+	return relocateELFFiles(keg, r)
+}
+
+// relocateTextFile replaces placeholders within a text file. Symlinks and
+// binary files are skipped.
+func relocateTextFile(path string, r *strings.Replacer) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("error reading file info for %q: %w", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading %q: %w", path, err)
+	}
+	if !bytes.Contains(data, []byte("@@HOMEBREW_")) || bytes.IndexByte(data, 0) != -1 {
+		return nil
+	}
+	perm := fi.Mode().Perm()
+	// Files in bottles are often read-only.
+	if err := os.Chmod(path, perm|0200); err != nil {
+		return fmt.Errorf("error making %q writable: %w", path, err)
+	}
+	if err := os.WriteFile(path, []byte(r.Replace(string(data))), perm); err != nil {
+		return fmt.Errorf("error writing %q: %w", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("error restoring permissions of %q: %w", path, err)
+	}
+	return nil
+}
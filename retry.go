@@ -0,0 +1,230 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how requests that fail with a 429, a 5xx or a reset
+// connection are retried. Fields that are zero use their defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a request is made before giving
+	// up. Defaults to 4, set it to 1 to disable retries.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles with every
+	// attempt after that. Defaults to 250ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts. A Retry-After header asking
+	// for longer than this isn't retried. Defaults to 10s.
+	MaxDelay time.Duration
+	// HedgeDelay is how long to wait for a manifest response before sending
+	// a second request and using whichever responds first. Zero disables
+	// hedging.
+	HedgeDelay time.Duration
+}
+
+// OptionWithRetry sets the retry policy of the http client.
+func OptionWithRetry(p RetryPolicy) func(*Brewery) {
+	return func(b *Brewery) { b.retry = p }
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 4
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 250 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 10 * time.Second
+	}
+	return p
+}
+
+// backoff returns the delay before retry number attempt, starting at 1, with
+// jitter so that concurrent requests don't retry in lockstep.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxDelay
+	if shift := attempt - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay {
+		d = p.BaseDelay << shift
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// withRetries returns a copy of c that retries requests according to p.
+func withRetries(c *http.Client, p RetryPolicy) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	retrying := *c
+	retrying.Transport = &retryTransport{next: next, policy: p.withDefaults()}
+	return &retrying
+}
+
+type hedgeKey struct{}
+
+// withHedging marks requests made with ctx as safe to hedge.
+func withHedging(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hedgeKey{}, true)
+}
+
+// retryTransport retries idempotent requests that fail in a way that is
+// likely to be temporary.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+	hedge, _ := req.Context().Value(hedgeKey{}).(bool)
+	hedge = hedge && t.policy.HedgeDelay > 0
+	for attempt := 1; ; attempt++ {
+		ctx, span := networkTracer.Start(req.Context(), fmt.Sprintf("HTTP %s attempt %d", req.Method, attempt))
+		var resp *http.Response
+		var err error
+		if hedge {
+			resp, err = t.hedgedRoundTrip(req.WithContext(ctx))
+		} else {
+			resp, err = t.next.RoundTrip(req.WithContext(ctx))
+		}
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+
+		delay, retry := t.shouldRetry(resp, err)
+		if !retry || attempt >= t.policy.MaxAttempts {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+		if delay == 0 {
+			delay = t.policy.backoff(attempt)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry reports whether the outcome of an attempt is worth retrying
+// and, if the server said so, how long to wait first.
+func (t *retryTransport) shouldRetry(resp *http.Response, err error) (delay time.Duration, retry bool) {
+	if err != nil {
+		return 0, errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF)
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+		return 0, false
+	}
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if ok && delay > t.policy.MaxDelay {
+		// Not worth waiting for, let the caller see the response.
+		return 0, false
+	}
+	return delay, true
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an http date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// hedgedRoundTrip sends req and, if there is no response within the hedge
+// delay, sends it again. The first successful response wins and the other
+// request is cancelled.
+func (t *retryTransport) hedgedRoundTrip(req *http.Request) (*http.Response, error) {
+	type result struct {
+		resp   *http.Response
+		err    error
+		cancel context.CancelFunc
+	}
+	results := make(chan result, 2)
+	send := func(ctx context.Context) {
+		ctx, cancel := context.WithCancel(ctx)
+		resp, err := t.next.RoundTrip(req.Clone(ctx))
+		results <- result{resp: resp, err: err, cancel: cancel}
+	}
+	go send(req.Context())
+	inflight := 1
+	timer := time.NewTimer(t.policy.HedgeDelay)
+	defer timer.Stop()
+
+	var err error
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			inflight++
+			go func() {
+				ctx, span := networkTracer.Start(req.Context(), "HTTP hedged request")
+				defer span.End()
+				send(ctx)
+			}()
+		case r := <-results:
+			inflight--
+			if r.err != nil {
+				// The other request may still succeed.
+				r.cancel()
+				err = r.err
+				continue
+			}
+			// Clean up after whichever request loses.
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					loser := <-results
+					loser.cancel()
+					if loser.resp != nil {
+						loser.resp.Body.Close()
+					}
+				}
+			}(inflight)
+			r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: r.cancel}
+			return r.resp, nil
+		}
+	}
+	return nil, err
+}
+
+// cancelOnClose cancels the context of a request once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,125 @@
+package brewery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryTransport(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	for _, tt := range []struct {
+		name     string
+		statuses []int
+		header   http.Header
+		want     int
+		attempts int32
+	}{
+		{"success", []int{200}, nil, 200, 1},
+		{"server error", []int{503, 502, 200}, nil, 200, 3},
+		{"too many requests", []int{429, 200}, http.Header{"Retry-After": {"0"}}, 200, 2},
+		{"gives up", []int{500, 500, 500, 200}, nil, 500, 3},
+		{"not found", []int{404, 200}, nil, 404, 1},
+		{"retry after too long", []int{429, 200}, http.Header{"Retry-After": {"3600"}}, 429, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer server.Close()
+
+			client := withRetries(server.Client(), policy)
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+			assert.Equal(t, tt.attempts, atomic.LoadInt32(&attempts))
+		})
+	}
+}
+
+func TestRetryConnectionReset(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// Drop the connection without a response.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	client := withRetries(server.Client(), RetryPolicy{BaseDelay: time.Millisecond})
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestHedgedRequests(t *testing.T) {
+	var attempts int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// The first request stalls until the test is done.
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		_, _ = io.WriteString(w, "hedged")
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := withRetries(server.Client(), RetryPolicy{HedgeDelay: 10 * time.Millisecond})
+	req, _ := http.NewRequestWithContext(withHedging(context.Background()), http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hedged", string(body))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+
+	// Requests that aren't marked are never hedged.
+	atomic.StoreInt32(&attempts, 1)
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	d, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, d)
+	d, ok = parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.InDelta(t, time.Hour.Seconds(), d.Seconds(), 5)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
@@ -0,0 +1,187 @@
+package brewery
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/maxmcd/brewery/internal/atomicfile"
+)
+
+// OptionWithStore keeps downloaded bottles and manifests in dir instead of
+// the cache, so that breweries with different prefixes can share them.
+func OptionWithStore(dir string) func(*Brewery) {
+	return func(b *Brewery) { b.storeLocation = dir }
+}
+
+// blobStore is a content-addressed store of bottles and manifests. Blobs are
+// stored at blobs/sha256/<digest> and are found through refs, small files
+// under refs/ that hold the digest of the blob they name. A blob shared by
+// several refs, like a bottle that was rebuilt without changing, is only
+// stored once.
+type blobStore struct {
+	dir string
+}
+
+func (b *Brewery) store() blobStore {
+	if b.storeLocation != "" {
+		return blobStore{dir: b.storeLocation}
+	}
+	return blobStore{dir: b.cacheLocation}
+}
+
+// bottleRef names the bottle for formula with the given tag, eg:
+// "bottles/ruby/3.2.2_1.x86_64_linux.1".
+func bottleRef(formula Formula, tag string) string {
+	return path.Join("bottles", formula.Name, formula.bottleRefName(tag))
+}
+
+// manifestRef names the bottle manifest for formula, eg:
+// "manifests/ruby/3.2.2_1-1".
+func manifestRef(formula Formula) string {
+	return path.Join("manifests", formula.Name, formula.annotatedVersion())
+}
+
+func (s blobStore) blobDir() string { return filepath.Join(s.dir, "blobs", "sha256") }
+
+func (s blobStore) blobPath(digest string) string {
+	return filepath.Join(s.blobDir(), strings.ToLower(strings.TrimPrefix(digest, "sha256:")))
+}
+
+func (s blobStore) refPath(ref string) string {
+	return filepath.Join(s.dir, "refs", filepath.FromSlash(ref))
+}
+
+func (s blobStore) has(digest string) bool {
+	_, err := os.Stat(s.blobPath(digest))
+	return err == nil
+}
+
+// resolve returns the digest that ref names, if the blob is in the store.
+// The modification time of the ref is updated to record when it was last
+// used, for CleanupCache.
+func (s blobStore) resolve(ref string) (digest string, found bool) {
+	loc := s.refPath(ref)
+	v, err := os.ReadFile(loc)
+	if err != nil {
+		return "", false
+	}
+	digest = strings.TrimSpace(string(v))
+	if !s.has(digest) {
+		return "", false
+	}
+	now := time.Now()
+	_ = os.Chtimes(loc, now, now)
+	return digest, true
+}
+
+// tag points ref at digest.
+func (s blobStore) tag(ref, digest string) error {
+	loc := s.refPath(ref)
+	mkdirIfNoExist(filepath.Dir(loc))
+	if err := atomicfile.WriteFile(loc, strings.NewReader(digest+"\n"), nil); err != nil {
+		return fmt.Errorf("error writing ref %s: %w", ref, err)
+	}
+	return nil
+}
+
+// put adds the content of r to the store, it must match digest.
+func (s blobStore) put(r io.Reader, name, digest string) error {
+	loc := s.blobPath(digest)
+	mkdirIfNoExist(filepath.Dir(loc))
+	h := sha256.New()
+	return atomicfile.WriteFile(loc, io.TeeReader(r, h), func() error {
+		if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, strings.TrimPrefix(digest, "sha256:")) {
+			return &ChecksumMismatchError{Name: name, Expected: digest, Actual: actual}
+		}
+		return nil
+	})
+}
+
+// putBytes adds v to the store under its own digest, which is returned.
+func (s blobStore) putBytes(v []byte, name string) (digest string, err error) {
+	sum := sha256.Sum256(v)
+	digest = hex.EncodeToString(sum[:])
+	if s.has(digest) {
+		return digest, nil
+	}
+	return digest, s.put(bytes.NewReader(v), name, digest)
+}
+
+// cachedBottle returns the path of the downloaded bottle for formula.
+func (b *Brewery) cachedBottle(formula Formula) (loc string, found bool) {
+	s := b.store()
+	tag := b.bottleOSString()
+	digest, found := s.resolve(bottleRef(formula, tag))
+	if !found {
+		return "", false
+	}
+	// A ref to another bottle, say one imported or pinned by an older
+	// lockfile, doesn't count, it's downloaded again and retagged.
+	if want := formula.Bottle.Stable.Files[tag].Sha256; want != "" && want != digest {
+		return "", false
+	}
+	return s.blobPath(digest), true
+}
+
+// VerifyStore rehashes every blob in the store and removes the ones that
+// don't match their digest, so that they are downloaded again when they are
+// next needed. The digests of the removed blobs are returned.
+func (b *Brewery) VerifyStore(ctx context.Context) (corrupt []string, err error) {
+	_, span := diskTracer.Start(ctx, "brewery.VerifyStore")
+	defer span.End()
+
+	dir := b.store().blobDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %q: %w", dir, err)
+	}
+	for _, e := range entries {
+		// Skip in progress downloads and writes.
+		if !e.Type().IsRegular() || strings.Contains(e.Name(), ".") {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return corrupt, err
+		}
+		loc := filepath.Join(dir, e.Name())
+		ok, err := verifyBlob(loc, e.Name())
+		if err != nil {
+			return corrupt, err
+		}
+		if !ok {
+			corrupt = append(corrupt, e.Name())
+			if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+				return corrupt, fmt.Errorf("error removing corrupt blob %q: %w", loc, err)
+			}
+		}
+	}
+	return corrupt, nil
+}
+
+func verifyBlob(loc, digest string) (bool, error) {
+	f, err := os.Open(loc)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error opening %q: %w", loc, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, fmt.Errorf("error reading %q: %w", loc, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)) == digest, nil
+}
@@ -0,0 +1,105 @@
+package brewery
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blobRequests(reg *testRegistry) (n int) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	for path, count := range reg.requests {
+		if strings.Contains(path, "/blobs/") {
+			n += count
+		}
+	}
+	return n
+}
+
+func TestStoreDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, testBottle{name: "foo", version: "1.0"})
+	b := reg.brewery(t)
+	download := func() Formula {
+		t.Helper()
+		formulas, err := b.findFormulas(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+			t.Fatal(err)
+		}
+		return formulas[0]
+	}
+	first := download()
+
+	// A rebuild with identical contents is a new ref to the same blob.
+	reg.set(testBottle{name: "foo", version: "1.0", rebuild: 1})
+	reg.writeIndex(t, b)
+	second := download()
+	assert.Equal(t, 1, blobRequests(reg))
+	firstBlob, _ := b.cachedBottle(first)
+	secondBlob, found := b.cachedBottle(second)
+	assert.True(t, found)
+	assert.Equal(t, firstBlob, secondBlob)
+	entries, _ := os.ReadDir(b.store().blobDir())
+	// One bottle and two manifests.
+	assert.Len(t, entries, 3)
+}
+
+func TestVerifyStore(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, testBottle{name: "foo", version: "1.0"})
+	b := reg.brewery(t)
+	formulas, err := b.findFormulas(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+	corrupt, err := b.VerifyStore(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, corrupt)
+
+	loc, _ := b.cachedBottle(formulas[0])
+	if err := os.WriteFile(loc, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt, err = b.VerifyStore(ctx); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{strings.TrimPrefix(loc, b.store().blobDir()+string(os.PathSeparator))}, corrupt)
+	if _, found := b.cachedBottle(formulas[0]); found {
+		t.Fatal("expected the corrupt bottle to be removed")
+	}
+
+	// It is downloaded again the next time it is needed.
+	if err := b.DownloadBottle(ctx, formulas[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, blobRequests(reg))
+}
+
+func TestSharedStore(t *testing.T) {
+	ctx := context.Background()
+	reg := newTestRegistry(t, testBottle{name: "foo", version: "1.0"})
+	store := t.TempDir()
+	for i := 0; i < 2; i++ {
+		b := reg.brewery(t)
+		OptionWithStore(store)(b)
+		if err := b.Install(ctx, "foo"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(b.cellar("foo", "1.0", "bin", "foo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 1, blobRequests(reg))
+}
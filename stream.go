@@ -0,0 +1,89 @@
+package brewery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OptionWithStreamingExtract extracts bottles while they are being
+// downloaded instead of saving them to the cache and reading them back. The
+// bottle is extracted into a staging directory that only replaces the
+// unpacked bottle once the digest of the download has been verified. Bottles
+// are not kept in the cache.
+func OptionWithStreamingExtract() func(*Brewery) {
+	return func(b *Brewery) { b.streamExtract = true }
+}
+
+// streamBottle downloads and extracts the bottle for formula in one pass.
+func (b *Brewery) streamBottle(ctx context.Context, formula Formula) (err error) {
+	if b.poured(formula) {
+		return nil
+	}
+	if _, found := b.cachedBottle(formula); found {
+		// Downloaded earlier, there is nothing to stream.
+		return b.extractBottle(ctx, formula)
+	}
+	u, err := b.stableBottleURL(formula)
+	if err != nil {
+		return fmt.Errorf("calculating bottle url: %w", err)
+	}
+	digest, err := b.expectedBottleDigest(ctx, formula)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := networkTracer.Start(ctx, "StreamBottle "+u)
+	defer span.End()
+	resp, err := b.registryGet(ctx, u, nil)
+	if err != nil {
+		return fmt.Errorf("error making request to %q: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	out := b.unpackedBottle(formula)
+	staging, err := os.MkdirTemp(filepath.Dir(out), filepath.Base(out)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating staging dir for %q: %w", out, err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(staging)
+		}
+	}()
+
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+	unpackErr := b.unarchive(body, staging)
+	// The extractor can stop short of the end of the body, but the digest
+	// covers all of it.
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return fmt.Errorf("error reading %q: %w", u, err)
+	}
+	// A corrupt download is the more likely reason extraction failed.
+	if actual := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(actual, digest) {
+		return &ChecksumMismatchError{Name: formula.Name, Expected: digest, Actual: actual}
+	}
+	if unpackErr != nil {
+		return fmt.Errorf("error unpacking archive: %w", unpackErr)
+	}
+	if err := os.RemoveAll(out); err != nil {
+		return fmt.Errorf("error removing %q: %w", out, err)
+	}
+	if err := os.Rename(staging, out); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %w", staging, out, err)
+	}
+	return nil
+}
+
+func (b *Brewery) streamFormula(ctx context.Context, formula Formula) error {
+	if err := b.streamBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error streaming bottle for %s: %w", formula.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStreamingExtract(t *testing.T) {
+	ctx := context.Background()
+	foo := testBottle{name: "foo", version: "1.0"}
+	reg := newTestRegistry(t, foo, testBottle{name: "bar", version: "1.0"})
+	b := reg.brewery(t)
+	OptionWithStreamingExtract()(b)
+
+	if err := b.Install(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.cellar("foo", "1.0", "bin", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := b.cachedBottle(foo.formula()); found {
+		t.Fatal("expected the bottle not to be cached")
+	}
+
+	// Serve the wrong bottle for bar.
+	reg.lock.Lock()
+	for path := range reg.blobs {
+		if strings.HasPrefix(path, "/v2/homebrew/core/bar/blobs/") {
+			reg.blobs[path] = testBottleArchive(t, testBottle{name: "bar", version: "2.0"})
+		}
+	}
+	reg.lock.Unlock()
+	err := b.Install(ctx, "bar")
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	entries, err := os.ReadDir(b.cache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "bar--") && e.IsDir() {
+			t.Fatalf("expected nothing to be extracted for bar, found %s", e.Name())
+		}
+	}
+}
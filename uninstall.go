@@ -0,0 +1,222 @@
+package brewery
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type UninstallOptions struct {
+	// Force uninstalls the formula even if other installed formulas depend
+	// on it.
+	Force bool
+	// Autoremove also uninstalls any formulas that were only installed as
+	// dependencies and are no longer needed.
+	Autoremove bool
+}
+
+// DependentsError is returned when uninstalling a formula that other
+// installed formulas depend on.
+type DependentsError struct {
+	Name       string
+	Dependents []string
+}
+
+func (e *DependentsError) Error() string {
+	return fmt.Sprintf("refusing to uninstall %s because it is required by %s",
+		e.Name, strings.Join(e.Dependents, ", "))
+}
+
+// installedKeg is a keg within the Cellar.
+type installedKeg struct {
+	Name    string
+	Version string
+	Path    string
+	// Receipt is the zero value if the keg has no install receipt.
+	Receipt Receipt
+}
+
+// dependsOn reports whether the keg has name as a runtime dependency.
+func (k installedKeg) dependsOn(name string) bool {
+	for _, d := range k.Receipt.RuntimeDependencies {
+		if d.FullName == name || strings.HasSuffix(d.FullName, "/"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// installedKegs lists every keg in the Cellar.
+func (b *Brewery) installedKegs() (kegs []installedKeg, err error) {
+	names, err := os.ReadDir(b.cellar())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cellar: %w", err)
+	}
+	for _, name := range names {
+		if !name.IsDir() {
+			continue
+		}
+		versions, err := os.ReadDir(b.cellar(name.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading cellar: %w", err)
+		}
+		for _, version := range versions {
+			// Dot directories are kegs being replaced by an upgrade.
+			if !version.IsDir() || strings.HasPrefix(version.Name(), ".") {
+				continue
+			}
+			keg := installedKeg{
+				Name:    name.Name(),
+				Version: version.Name(),
+				Path:    b.cellar(name.Name(), version.Name()),
+			}
+			// Kegs without a receipt are treated as installed on request
+			// with no dependencies.
+			keg.Receipt, _ = ReadReceipt(keg.Path)
+			kegs = append(kegs, keg)
+		}
+	}
+	return kegs, nil
+}
+
+// Uninstall unlinks and removes every installed version of the named
+// formula. The names of all formulas that were removed are returned.
+func (b *Brewery) Uninstall(ctx context.Context, name string, opts UninstallOptions) (removed []string, err error) {
+	_, span := diskTracer.Start(ctx, "Uninstall "+name)
+	defer span.End()
+
+	kegs, err := b.installedKegs()
+	if err != nil {
+		return nil, err
+	}
+	var targets []installedKeg
+	var dependents []string
+	for _, k := range kegs {
+		if k.Name == name {
+			targets = append(targets, k)
+		} else if k.dependsOn(name) {
+			dependents = append(dependents, k.Name)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s is not installed", name)
+	}
+	if len(dependents) > 0 && !opts.Force {
+		return nil, &DependentsError{Name: name, Dependents: dependents}
+	}
+	if err := b.removeKegs(targets); err != nil {
+		return nil, err
+	}
+	removed = append(removed, name)
+
+	if !opts.Autoremove {
+		return removed, nil
+	}
+	for {
+		kegs, err := b.installedKegs()
+		if err != nil {
+			return removed, err
+		}
+		orphans := orphanedKegs(kegs)
+		if len(orphans) == 0 {
+			return removed, nil
+		}
+		if err := b.removeKegs(orphans); err != nil {
+			return removed, err
+		}
+		for _, k := range orphans {
+			removed = append(removed, k.Name)
+		}
+	}
+}
+
+// orphanedKegs returns the kegs that were installed as dependencies but that
+// no other installed keg depends on.
+func orphanedKegs(kegs []installedKeg) (orphans []installedKeg) {
+	for _, k := range kegs {
+		if !k.Receipt.InstalledAsDependency || k.Receipt.InstalledOnRequest {
+			continue
+		}
+		needed := false
+		for _, other := range kegs {
+			if other.Name != k.Name && other.dependsOn(k.Name) {
+				needed = true
+				break
+			}
+		}
+		if !needed {
+			orphans = append(orphans, k)
+		}
+	}
+	return orphans
+}
+
+func (b *Brewery) removeKegs(kegs []installedKeg) error {
+	for _, k := range kegs {
+		if err := b.unlink(k.Name, k.Path); err != nil {
+			return fmt.Errorf("error unlinking %s: %w", k.Name, err)
+		}
+		if err := os.RemoveAll(k.Path); err != nil {
+			return fmt.Errorf("error removing %q: %w", k.Path, err)
+		}
+		// Only succeeds once no other versions are left.
+		_ = os.Remove(b.cellar(k.Name))
+	}
+	return nil
+}
+
+// unlink removes the links in the prefix that point into the keg at path,
+// along with any directories that are left empty.
+func (b *Brewery) unlink(name, keg string) error {
+	var dirs []string
+	for _, linkDir := range linkDirs {
+		root := filepath.Join(keg, linkDir)
+		if _, err := os.Lstat(root); os.IsNotExist(err) {
+			continue
+		}
+		if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(keg, path)
+			dst := filepath.Join(b.prefix, rel)
+			if d.IsDir() {
+				if path != root {
+					dirs = append(dirs, dst)
+				}
+				return nil
+			}
+			return removeLinkInto(dst, keg)
+		}); err != nil {
+			return fmt.Errorf("error walking %q: %w", root, err)
+		}
+	}
+	// Deepest directories first so parents are empty by the time they are
+	// reached. Removing a directory that isn't empty fails, which is fine.
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		_ = os.Remove(dir)
+	}
+	if err := removeLinkInto(b.opt(name), keg); err != nil {
+		return err
+	}
+	return removeLinkInto(b.linkedKegs(name), keg)
+}
+
+// removeLinkInto removes the symlink at path if it points at or into dir.
+func removeLinkInto(path, dir string) error {
+	if !symlinkPointsInto(path, dir) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error removing %q: %w", path, err)
+	}
+	return nil
+}
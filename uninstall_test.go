@@ -0,0 +1,70 @@
+package brewery
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// installTestKeg pours and links a keg with the given runtime dependencies.
+func installTestKeg(t *testing.T, b *Brewery, name string, onRequest bool, deps ...string) {
+	f := linkTestFormula(t, "")
+	f.Name = name
+	writeTestFiles(t, b.unpackedKeg(f), "bin/"+name, "lib/pkgconfig/"+name+".pc")
+	if _, err := b.Link(context.Background(), f, LinkOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tb := BrewTab{}
+	for _, dep := range deps {
+		tb.RuntimeDependencies = append(tb.RuntimeDependencies, Dependency{FullName: dep})
+	}
+	if err := writeReceiptFile(b.cellar(name, f.pkgVersion()), b.newReceipt(f, tb, onRequest)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	ctx := context.Background()
+	b := &Brewery{prefix: t.TempDir(), cacheLocation: t.TempDir()}
+	installTestKeg(t, b, "libyaml", false)
+	installTestKeg(t, b, "openssl", false)
+	installTestKeg(t, b, "ruby", true, "libyaml", "homebrew/core/openssl")
+	installTestKeg(t, b, "wget", true, "openssl")
+
+	_, err := b.Uninstall(ctx, "openssl", UninstallOptions{})
+	var dependents *DependentsError
+	if !errors.As(err, &dependents) {
+		t.Fatalf("expected dependents error, got %v", err)
+	}
+	assert.Equal(t, []string{"ruby", "wget"}, dependents.Dependents)
+
+	removed, err := b.Uninstall(ctx, "ruby", UninstallOptions{Autoremove: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// openssl is still needed by wget.
+	assert.Equal(t, []string{"ruby", "libyaml"}, removed)
+	for _, path := range []string{"bin/ruby", "bin/libyaml", "lib/pkgconfig/ruby.pc", "opt/ruby", "Cellar/ruby"} {
+		if _, err := os.Lstat(filepath.Join(b.prefix, path)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", path, err)
+		}
+	}
+	for _, path := range []string{"bin/wget", "bin/openssl", "lib/pkgconfig/openssl.pc"} {
+		if _, err := os.Stat(filepath.Join(b.prefix, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err = b.Uninstall(ctx, "openssl", UninstallOptions{Force: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"openssl"}, removed)
+	if _, err := b.Uninstall(ctx, "openssl", UninstallOptions{}); err == nil {
+		t.Fatal("expected error uninstalling a formula that isn't installed")
+	}
+}
@@ -0,0 +1,348 @@
+package brewery
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// OutdatedFormula is an installed formula with a newer bottle available.
+type OutdatedFormula struct {
+	Name              string
+	InstalledVersions []string
+	CurrentVersion    string
+
+	formula Formula
+	kegs    []installedKeg
+}
+
+// annotatedVersion is the version of the keg including the bottle rebuild,
+// when it is known, comparable with Formula.annotatedVersion.
+func (k installedKeg) annotatedVersion() string {
+	if k.Receipt.BottleRebuild != nil && *k.Receipt.BottleRebuild != 0 {
+		return fmt.Sprintf("%s-%d", k.Version, *k.Receipt.BottleRebuild)
+	}
+	return k.Version
+}
+
+// compare orders the keg against the bottle of formula by version, then
+// revision, then rebuild. A keg with an unknown rebuild compares equal to
+// every rebuild of its version.
+func (k installedKeg) compare(formula Formula) int {
+	stable, revision := splitPkgVersion(k.Version)
+	if c := compareVersions(stable, formula.Versions.Stable); c != 0 {
+		return c
+	}
+	if c := compareInts(revision, formula.Revision); c != 0 || k.Receipt.BottleRebuild == nil {
+		return c
+	}
+	return compareInts(*k.Receipt.BottleRebuild, formula.Bottle.Stable.Rebuild)
+}
+
+// splitPkgVersion splits the name of a keg, eg: "3.2.2_1", into the stable
+// version and the revision.
+func splitPkgVersion(v string) (stable string, revision int) {
+	if i := strings.LastIndex(v, "_"); i > 0 {
+		if r, err := strconv.Atoi(v[i+1:]); err == nil {
+			return v[:i], r
+		}
+	}
+	return v, 0
+}
+
+// compareVersions orders two stable versions the way brew does. Versions
+// are split into runs of digits and letters and compared run by run,
+// numbers numerically. Missing trailing numbers count as zero, so "1.0" is
+// "1.0.0". Trailing letters come after the version, as in "1.1.1w", unless
+// they mark a pre-release, as in "1.0rc1".
+func compareVersions(a, b string) int {
+	as, bs := versionParts(a), versionParts(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		switch {
+		case i >= len(as):
+			return -compareMissingPart(bs[i])
+		case i >= len(bs):
+			return compareMissingPart(as[i])
+		}
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = compareInts(an, bn)
+		case aErr == nil:
+			c = 1
+		case bErr == nil:
+			c = -1
+		default:
+			c = strings.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareMissingPart compares a part of a version with the other version
+// having run out of parts.
+func compareMissingPart(part string) int {
+	n, err := strconv.Atoi(part)
+	switch {
+	case err != nil && prereleases[part]:
+		return -1
+	case err != nil, n > 0:
+		return 1
+	}
+	return 0
+}
+
+var prereleases = map[string]bool{"alpha": true, "beta": true, "pre": true, "rc": true}
+
+// versionParts splits v into runs of digits and runs of letters, dropping
+// everything else.
+func versionParts(v string) (parts []string) {
+	start := -1
+	for i, r := range v + "." {
+		digit := r >= '0' && r <= '9'
+		letter := unicode.IsLetter(r)
+		if start >= 0 {
+			prev := rune(v[start])
+			if digit == (prev >= '0' && prev <= '9') && (digit || letter) {
+				continue
+			}
+			parts = append(parts, strings.ToLower(v[start:i]))
+			start = -1
+		}
+		if digit || letter {
+			start = i
+		}
+	}
+	return parts
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (b *Brewery) pinned(name string) bool {
+	_, err := os.Lstat(filepath.Join(b.prefix, "var", "homebrew", "pinned", name))
+	return err == nil
+}
+
+// Outdated compares the kegs in the Cellar with the formula index and
+// returns the formulas that have a newer version, revision or bottle rebuild
+// available. Pinned formulas and formulas that are no longer in the index
+// are skipped, as are formulas with a keg newer than the index.
+func (b *Brewery) Outdated(ctx context.Context) (outdated []OutdatedFormula, err error) {
+	kegs, err := b.installedKegs()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string][]installedKeg{}
+	var names []string
+	for _, k := range kegs {
+		if b.pinned(k.Name) {
+			continue
+		}
+		if _, found := byName[k.Name]; !found {
+			names = append(names, k.Name)
+		}
+		byName[k.Name] = append(byName[k.Name], k)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	formulas, resolved, _, err := b.resolveFormulas(ctx, names...)
+	if err != nil {
+		return nil, err
+	}
+	// Kegs installed under an old name belong to the renamed formula.
+	kegNames := map[string][]string{}
+	for _, r := range resolved {
+		kegNames[r.Name] = append(kegNames[r.Name], r.Requested)
+	}
+	for _, formula := range formulas {
+		current := formula.annotatedVersion()
+		o := OutdatedFormula{Name: formula.Name, CurrentVersion: current, formula: formula}
+		var kegs []installedKeg
+		for _, name := range kegNames[formula.Name] {
+			kegs = append(kegs, byName[name]...)
+		}
+		upToDate := false
+		for _, k := range kegs {
+			upToDate = upToDate || k.compare(formula) >= 0
+			o.InstalledVersions = append(o.InstalledVersions, k.annotatedVersion())
+			o.kegs = append(o.kegs, k)
+		}
+		if !upToDate {
+			outdated = append(outdated, o)
+		}
+	}
+	sort.Slice(outdated, func(i, j int) bool { return outdated[i].Name < outdated[j].Name })
+	return outdated, nil
+}
+
+// Upgrade installs the newest bottles of the named formulas, or of every
+// outdated formula if no names are given, and links them in place of the
+// old versions. Outdated dependencies are upgraded first and missing ones
+// are installed, both are included in upgraded. The old kegs are removed
+// unless OptionWithKeepOldKegs is set.
+func (b *Brewery) Upgrade(ctx context.Context, names ...string) (upgraded []OutdatedFormula, err error) {
+	ctx, span := diskTracer.Start(ctx, "Upgrade")
+	defer span.End()
+
+	outdated, err := b.Outdated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]struct{}{}
+	if len(names) > 0 {
+		resolved, err := b.Resolve(ctx, names...)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range resolved {
+			wanted[r.Name] = struct{}{}
+		}
+	}
+	byName := map[string]OutdatedFormula{}
+	var roots []string
+	for _, o := range outdated {
+		byName[o.Name] = o
+		if _, found := wanted[o.Name]; len(names) > 0 && !found {
+			continue
+		}
+		roots = append(roots, o.Name)
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+
+	g, err := b.dependencyGraph(ctx, roots...)
+	if err != nil {
+		return nil, err
+	}
+	for _, formula := range g.sorted() {
+		o, found := byName[formula.Name]
+		switch {
+		case found:
+			err = b.upgrade(ctx, o)
+		case b.installed(formula.Name):
+			// Up to date or pinned.
+			continue
+		default:
+			o = OutdatedFormula{Name: formula.Name, CurrentVersion: formula.annotatedVersion(), formula: formula}
+			err = b.installFormula(ctx, formula, false)
+		}
+		if err != nil {
+			return upgraded, fmt.Errorf("error upgrading %s: %w", formula.Name, err)
+		}
+		upgraded = append(upgraded, o)
+	}
+	return upgraded, nil
+}
+
+func (b *Brewery) installed(name string) bool {
+	_, err := os.Stat(b.cellar(name))
+	return err == nil
+}
+
+func (b *Brewery) upgrade(ctx context.Context, o OutdatedFormula) error {
+	onRequest := false
+	var old []installedKeg
+	var replaced *installedKeg
+	newKeg := b.cellar(o.Name, o.formula.pkgVersion())
+	for _, k := range o.kegs {
+		k := k
+		onRequest = onRequest || !k.Receipt.InstalledAsDependency
+		if k.Path == newKeg {
+			replaced = &k
+			continue
+		}
+		old = append(old, k)
+	}
+
+	var err error
+	if replaced != nil {
+		err = b.replaceKeg(ctx, o.formula, *replaced, onRequest)
+	} else {
+		err = b.installFormula(ctx, o.formula, onRequest)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Linking the new keg replaced the links the versions have in common,
+	// clear out the rest.
+	for _, k := range old {
+		if err := b.unlink(k.Name, k.Path); err != nil {
+			return fmt.Errorf("error unlinking %s %s: %w", k.Name, k.Version, err)
+		}
+		if b.keepOldKegs {
+			continue
+		}
+		if err := os.RemoveAll(k.Path); err != nil {
+			return fmt.Errorf("error removing %q: %w", k.Path, err)
+		}
+	}
+	return nil
+}
+
+// replaceKeg pours a rebuilt bottle of the same version as k into its keg.
+// The bottle is downloaded and unpacked before k is touched, and k is moved
+// aside rather than removed until the new keg is poured, so a failure
+// leaves k installed.
+func (b *Brewery) replaceKeg(ctx context.Context, formula Formula, k installedKeg, onRequest bool) error {
+	if err := b.DownloadBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
+	}
+	if err := b.extract(formula); err != nil {
+		return err
+	}
+	if err := b.relocateBottle(ctx, formula, b.unpackedBottle(formula)); err != nil {
+		return fmt.Errorf("error unpacking bottle for %s: %w", formula.Name, err)
+	}
+	// Dot directories aren't kegs, so brew and installedKegs skip it.
+	aside := filepath.Join(filepath.Dir(k.Path), "."+filepath.Base(k.Path)+".old")
+	if err := os.RemoveAll(aside); err != nil {
+		return fmt.Errorf("error removing %q: %w", aside, err)
+	}
+	if err := os.Rename(k.Path, aside); err != nil {
+		return fmt.Errorf("error moving %q aside: %w", k.Path, err)
+	}
+	if err := b.pourFormula(ctx, formula, onRequest); err != nil {
+		// Put the old keg back, its links point at the same path.
+		if rmErr := os.RemoveAll(k.Path); rmErr == nil {
+			_ = os.Rename(aside, k.Path)
+		}
+		return err
+	}
+	if err := os.RemoveAll(aside); err != nil {
+		return fmt.Errorf("error removing %q: %w", aside, err)
+	}
+	return nil
+}
+
+// installFormula downloads, pours and links a single formula.
+func (b *Brewery) installFormula(ctx context.Context, formula Formula, onRequest bool) error {
+	if err := b.DownloadBottle(ctx, formula); err != nil {
+		return fmt.Errorf("error downloading bottle for %s: %w", formula.Name, err)
+	}
+	if err := b.unpackFormula(ctx, formula); err != nil {
+		return err
+	}
+	return b.pourFormula(ctx, formula, onRequest)
+}
@@ -0,0 +1,252 @@
+package brewery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutdatedAndUpgrade(t *testing.T) {
+	ctx := context.Background()
+	libfoo := testBottle{name: "libfoo", version: "1.0", files: map[string]string{"lib/libfoo.so": "1.0"}}
+	foo := testBottle{name: "foo", version: "1.0", deps: []string{"libfoo"},
+		files: map[string]string{"share/foo/old.txt": "old"}}
+	registry := newTestRegistry(t, libfoo, foo)
+	b := registry.brewery(t)
+
+	if err := b.Install(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outdated)
+
+	// A new revision of foo and a rebuild of libfoo.
+	foo.revision, foo.files = 1, map[string]string{"share/foo/new.txt": "new"}
+	libfoo.rebuild = 1
+	registry.set(libfoo, foo)
+	registry.writeIndex(t, b)
+
+	outdated, err = b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, outdated, 2) {
+		assert.Equal(t, "foo", outdated[0].Name)
+		assert.Equal(t, []string{"1.0"}, outdated[0].InstalledVersions)
+		assert.Equal(t, "1.0_1", outdated[0].CurrentVersion)
+		assert.Equal(t, "libfoo", outdated[1].Name)
+		assert.Equal(t, "1.0-1", outdated[1].CurrentVersion)
+	}
+
+	upgraded, err := b.Upgrade(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, upgraded, 2)
+	outdated, err = b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outdated)
+
+	for _, path := range []string{"Cellar/foo/1.0", "share/foo/old.txt"} {
+		if _, err := os.Lstat(filepath.Join(b.prefix, path)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", path, err)
+		}
+	}
+	for _, path := range []string{"bin/foo", "share/foo/new.txt", "lib/libfoo.so"} {
+		if _, err := os.Stat(filepath.Join(b.prefix, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := ReadReceipt(b.cellar("foo", "1.0_1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, r.InstalledOnRequest)
+	r, err = ReadReceipt(b.cellar("libfoo", "1.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, r.InstalledAsDependency)
+	if assert.NotNil(t, r.BottleRebuild) {
+		assert.Equal(t, 1, *r.BottleRebuild)
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.10", "1.9", 1},
+		{"1.0.1", "1.0", 1},
+		{"1.1.1w", "1.1.1", 1},
+		{"1.1.1w", "1.1.1v", 1},
+		{"1.0rc1", "1.0", -1},
+		{"1.0-beta2", "1.0-beta10", -1},
+		{"2023-01-02", "2022-12-31", 1},
+	} {
+		assert.Equal(t, tt.want, compareVersions(tt.a, tt.b), "%s <=> %s", tt.a, tt.b)
+		assert.Equal(t, -tt.want, compareVersions(tt.b, tt.a), "%s <=> %s", tt.b, tt.a)
+	}
+}
+
+func TestOutdatedUnknownAndNewer(t *testing.T) {
+	ctx := context.Background()
+	foo := testBottle{name: "foo", version: "1.0", rebuild: 1}
+	registry := newTestRegistry(t, foo)
+	b := registry.brewery(t)
+	if err := b.Install(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// brew doesn't record the rebuild, so it is unknown.
+	loc := filepath.Join(b.cellar("foo", "1.0"), receiptFilename)
+	v, err := os.ReadFile(loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt map[string]interface{}
+	if err := json.Unmarshal(v, &receipt); err != nil {
+		t.Fatal(err)
+	}
+	delete(receipt, "bottle_rebuild")
+	v, _ = json.Marshal(receipt)
+	if err := os.WriteFile(loc, v, 0644); err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outdated)
+
+	// A keg newer than the index isn't downgraded.
+	registry.set(testBottle{name: "foo", version: "0.9"})
+	registry.writeIndex(t, b)
+	outdated, err = b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outdated)
+}
+
+func TestUpgradeFailureKeepsKeg(t *testing.T) {
+	ctx := context.Background()
+	foo := testBottle{name: "foo", version: "1.0"}
+	registry := newTestRegistry(t, foo)
+	b := registry.brewery(t)
+	if err := b.Install(ctx, "foo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rebuild whose bottle can't be downloaded.
+	foo.rebuild, foo.files = 1, map[string]string{"share/foo/rebuilt.txt": "rebuilt"}
+	registry.set(foo)
+	registry.writeIndex(t, b)
+	registry.lock.Lock()
+	for p := range registry.blobs {
+		if strings.Contains(p, "/foo/blobs/") {
+			delete(registry.blobs, p)
+		}
+	}
+	registry.lock.Unlock()
+
+	if _, err := b.Upgrade(ctx); err == nil {
+		t.Fatal("expected the upgrade to fail")
+	}
+	if _, err := os.Stat(filepath.Join(b.prefix, "bin", "foo")); err != nil {
+		t.Fatal(err)
+	}
+	outdated, err := b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, outdated, 1) {
+		assert.Equal(t, []string{"1.0"}, outdated[0].InstalledVersions)
+	}
+}
+
+func TestOutdatedRenamed(t *testing.T) {
+	ctx := context.Background()
+	registry := newTestRegistry(t, testBottle{name: "baz", version: "1.0"})
+	b := registry.brewery(t)
+	if err := b.Install(ctx, "baz"); err != nil {
+		t.Fatal(err)
+	}
+
+	registry.set(testBottle{name: "bar", version: "2.0", oldnames: []string{"baz"}})
+	registry.writeIndex(t, b)
+	outdated, err := b.Outdated(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, outdated, 1) {
+		assert.Equal(t, "bar", outdated[0].Name)
+		assert.Equal(t, []string{"1.0"}, outdated[0].InstalledVersions)
+	}
+
+	if _, err := b.Upgrade(ctx, "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(b.cellar("bar", "2.0")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"Cellar/baz/1.0", "bin/baz"} {
+		if _, err := os.Lstat(filepath.Join(b.prefix, path)); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be removed: %v", path, err)
+		}
+	}
+}
+
+func TestUpgradeDependencies(t *testing.T) {
+	ctx := context.Background()
+	libfoo := testBottle{name: "libfoo", version: "1.0"}
+	foo := testBottle{name: "foo", version: "1.0", deps: []string{"libfoo"}}
+	registry := newTestRegistry(t, libfoo, foo, testBottle{name: "bar", version: "1.0"})
+	b := registry.brewery(t)
+	for _, name := range []string{"foo", "bar"} {
+		if err := b.Install(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The new foo needs the new libfoo and a new dependency, bar is outdated
+	// but not asked for.
+	libfoo.version, foo.version = "2.0", "2.0"
+	foo.deps = []string{"libfoo", "libbar"}
+	registry.set(libfoo, foo, testBottle{name: "libbar", version: "1.0"}, testBottle{name: "bar", version: "2.0"})
+	registry.writeIndex(t, b)
+
+	upgraded, err := b.Upgrade(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := mapSlice(upgraded, func(o OutdatedFormula) string { return o.Name })
+	assert.ElementsMatch(t, []string{"libfoo", "libbar", "foo"}, names)
+	assert.Equal(t, "foo", names[len(names)-1])
+	for _, keg := range []string{"libfoo/2.0", "libbar/1.0", "foo/2.0", "bar/1.0"} {
+		if _, err := os.Stat(b.cellar(keg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(b.cellar("libfoo", "1.0")); !os.IsNotExist(err) {
+		t.Fatalf("expected the old libfoo keg to be removed: %v", err)
+	}
+	r, err := ReadReceipt(b.cellar("libfoo", "2.0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, r.InstalledAsDependency)
+}